@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+// apiHandler serves the HTTP API that changes the state of UPS devices
+type apiHandler struct {
+	metrics   *metricsHandler
+	token     string
+	commands  []string
+	variables []string
+}
+
+// apiResponse is the body of every API response
+type apiResponse struct {
+	Target     string `json:"target,omitempty"`
+	Ups        string `json:"ups"`
+	Command    string `json:"command,omitempty"`
+	Variable   string `json:"variable,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Previous   string `json:"previous,omitempty"`
+	TrackingID string `json:"tracking_id,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	Variables []apiVariable `json:"variables,omitempty"`
+}
+
+// apiVariable is a writable variable in the response of the variables endpoint
+type apiVariable struct {
+	collectors.WritableVariable
+	// Allowed reports whether the variable may be set through the API
+	Allowed bool `json:"allowed"`
+}
+
+func newAPIHandler(metrics *metricsHandler) (*apiHandler, error) {
+	token := os.Getenv("NUT_EXPORTER_API_TOKEN")
+	if token == "" {
+		return nil, errors.New("the NUT_EXPORTER_API_TOKEN environment variable must be set")
+	}
+
+	if *apiUsername != "" {
+		apiPassword = os.Getenv("NUT_EXPORTER_API_PASSWORD")
+		if apiPassword == "" {
+			return nil, errors.New("API username set, but NUT_EXPORTER_API_PASSWORD environment variable missing")
+		}
+	}
+
+	commands := splitVariables(*apiCommands)
+	variables := splitVariables(*apiVariables)
+	for _, pattern := range append(slices.Clone(commands), variables...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return &apiHandler{
+		metrics:   metrics,
+		token:     token,
+		commands:  commands,
+		variables: variables,
+	}, nil
+}
+
+// authorize checks the bearer token of the request and answers it if the token is wrong
+func (a *apiHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+		return true
+	}
+	logger.Warn("Audit: rejected API request with invalid token", "remote", r.RemoteAddr, "path", r.URL.Path)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeJSON(w, http.StatusUnauthorized, apiResponse{Ups: r.PathValue("name"), Error: "invalid or missing token"})
+	return false
+}
+
+// opts resolves the NUT server of an API request. Unlike scrapes, requests may only select a
+// configured target so that the API can not be pointed at arbitrary servers.
+func (a *apiHandler) opts(target string) (collectors.NutCollectorOpts, error) {
+	a.metrics.mu.Lock()
+	defer a.metrics.mu.Unlock()
+
+	opts := collectorOpts
+	targetUser := false
+	if target != "" {
+		targetConfig, ok := a.metrics.config.Targets[target]
+		if !ok {
+			return opts, errUnknownTarget
+		}
+		opts = targetConfig.Apply(opts)
+		targetUser = targetConfig.Username != ""
+	}
+
+	if *apiUsername != "" {
+		opts.Username = *apiUsername
+		opts.Password = apiPassword
+	} else if !targetUser && a.metrics.credentials != nil {
+		a.metrics.credentials.apply(&opts)
+	}
+	return opts, nil
+}
+
+// commandHandler serves POST /api/v1/ups/{name}/commands/{command}
+func (a *apiHandler) commandHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	response := apiResponse{
+		Target:  r.URL.Query().Get("target"),
+		Ups:     r.PathValue("name"),
+		Command: r.PathValue("command"),
+	}
+	value := r.URL.Query().Get("value")
+
+	if !matchesAny(a.commands, response.Command) {
+		logger.Warn("Audit: rejected instant command not in the allowlist", "remote", r.RemoteAddr, "target", response.Target, "ups", response.Ups, "command", response.Command)
+		response.Error = "command is not allowed"
+		writeJSON(w, http.StatusForbidden, response)
+		return
+	}
+
+	opts, err := a.opts(response.Target)
+	if err != nil {
+		response.Error = err.Error()
+		writeJSON(w, http.StatusNotFound, response)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *apiTimeout)
+	defer cancel()
+	result, err := collectors.RunCommand(ctx, opts, logger, response.Ups, response.Command, value)
+	response.TrackingID = result.TrackingID
+	response.Status = result.Status
+	logger.Info("Audit: instant command", "remote", r.RemoteAddr, "target", response.Target, "server", opts.Server, "user", opts.Username, "ups", response.Ups, "command", response.Command, "value", value, "tracking_id", result.TrackingID, "status", result.Status, "err", err)
+
+	a.writeResult(w, response, err)
+}
+
+// variablesHandler serves GET /api/v1/ups/{name}/variables
+func (a *apiHandler) variablesHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	response := apiResponse{
+		Target: r.URL.Query().Get("target"),
+		Ups:    r.PathValue("name"),
+	}
+
+	opts, err := a.opts(response.Target)
+	if err != nil {
+		response.Error = err.Error()
+		writeJSON(w, http.StatusNotFound, response)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *apiTimeout)
+	defer cancel()
+	variables, err := collectors.ListWritable(ctx, opts, logger, response.Ups)
+	if err != nil {
+		a.writeResult(w, response, err)
+		return
+	}
+
+	response.Variables = make([]apiVariable, 0, len(variables))
+	for _, variable := range variables {
+		response.Variables = append(response.Variables, apiVariable{
+			WritableVariable: variable,
+			Allowed:          matchesAny(a.variables, variable.Name),
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// setHandler serves POST /api/v1/ups/{name}/variables/{variable}
+func (a *apiHandler) setHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	response := apiResponse{
+		Target:   r.URL.Query().Get("target"),
+		Ups:      r.PathValue("name"),
+		Variable: r.PathValue("variable"),
+		Value:    r.URL.Query().Get("value"),
+	}
+
+	if !matchesAny(a.variables, response.Variable) {
+		logger.Warn("Audit: rejected set of variable not in the allowlist", "remote", r.RemoteAddr, "target", response.Target, "ups", response.Ups, "variable", response.Variable, "value", response.Value)
+		response.Error = "variable is not allowed"
+		writeJSON(w, http.StatusForbidden, response)
+		return
+	}
+	if !r.URL.Query().Has("value") {
+		response.Error = "the value query string parameter is required"
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	}
+
+	opts, err := a.opts(response.Target)
+	if err != nil {
+		response.Error = err.Error()
+		writeJSON(w, http.StatusNotFound, response)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *apiTimeout)
+	defer cancel()
+	previous, result, err := collectors.SetVariable(ctx, opts, logger, response.Ups, response.Variable, response.Value)
+	response.Previous = previous.Value
+	response.TrackingID = result.TrackingID
+	response.Status = result.Status
+	logger.Info("Audit: set variable", "remote", r.RemoteAddr, "target", response.Target, "server", opts.Server, "user", opts.Username, "ups", response.Ups, "variable", response.Variable, "previous", previous.Value, "value", response.Value, "tracking_id", result.TrackingID, "status", result.Status, "err", err)
+
+	a.writeResult(w, response, err)
+}
+
+// writeResult answers an API request with the outcome of a tracked request
+func (a *apiHandler) writeResult(w http.ResponseWriter, response apiResponse, err error) {
+	var nutErr *nutclient.Error
+	switch {
+	case errors.As(err, &nutErr):
+		response.Status = nutErr.Code
+		response.Error = err.Error()
+		switch nutErr.Code {
+		case "UNKNOWN-UPS", "CMD-NOT-SUPPORTED", "VAR-NOT-SUPPORTED":
+			writeJSON(w, http.StatusNotFound, response)
+		case "INVALID-ARGUMENT", "INVALID-VALUE", "TOO-LONG", "READONLY":
+			writeJSON(w, http.StatusBadRequest, response)
+		default:
+			writeJSON(w, http.StatusBadGateway, response)
+		}
+	case err != nil:
+		response.Error = err.Error()
+		writeJSON(w, http.StatusServiceUnavailable, response)
+	case response.Status == nutclient.TrackingPending:
+		writeJSON(w, http.StatusAccepted, response)
+	case response.Status == nutclient.TrackingSuccess || response.Status == collectors.TrackingUnsupported:
+		writeJSON(w, http.StatusOK, response)
+	default:
+		//The driver reported a failure
+		writeJSON(w, http.StatusBadGateway, response)
+	}
+}
+
+// matchesAny reports whether name matches one of the patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, response apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
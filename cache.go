@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+// Reasons for evicting a cached handler
+const (
+	evictExpired  = "expired"
+	evictCapacity = "capacity"
+	evictReload   = "reload"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nut_exporter",
+		Name:      "handler_cache_hits_total",
+		Help:      "Scrapes served by a cached collector.",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nut_exporter",
+		Name:      "handler_cache_misses_total",
+		Help:      "Scrapes that created a new collector.",
+	})
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nut_exporter",
+		Name:      "handler_cache_evictions_total",
+		Help:      "Collectors dropped from the cache by reason (expired, capacity or reload).",
+	}, []string{"reason"})
+	cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nut_exporter",
+		Name:      "handler_cache_entries",
+		Help:      "Number of cached collectors.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses, cacheEvictions, cacheEntries)
+	for _, reason := range []string{evictExpired, evictCapacity, evictReload} {
+		cacheEvictions.WithLabelValues(reason)
+	}
+}
+
+// cacheKey identifies a handler by its target and every collector option, so that scrapes
+// overriding any setting get a collector of their own. Credentials are only kept hashed.
+func cacheKey(target string, opts collectors.NutCollectorOpts) string {
+	encoded, err := json.Marshal(opts)
+	if err != nil {
+		//Options are plain data, this does not happen
+		panic(fmt.Sprintf("failure encoding collector options: %s", err))
+	}
+	sum := sha256.Sum256(append([]byte(target+"\x00"), encoded...))
+	return hex.EncodeToString(sum[:])
+}
+
+type cacheEntry struct {
+	key      string
+	name     string
+	handler  *cachedHandler
+	lastUsed time.Time
+}
+
+// handlerCache holds the handlers of recent scrapes. Handlers unused for longer than ttl are
+// dropped and the least recently used ones are dropped beyond maxEntries. Zero disables either
+// limit. Collectors of dropped handlers are closed.
+type handlerCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries from the most to the least recently used
+	order *list.List
+}
+
+func newHandlerCache(ttl time.Duration, maxEntries int) *handlerCache {
+	return &handlerCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// get returns the handler cached under key, if any, and marks it as used
+func (c *handlerCache) get(key string) (*cachedHandler, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(time.Now())
+
+	element, ok := c.entries[key]
+	if !ok {
+		cacheMisses.Inc()
+		return nil, false
+	}
+	cacheHits.Inc()
+	element.Value.(*cacheEntry).lastUsed = time.Now()
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).handler, true
+}
+
+// add caches a handler under key. If another scrape cached one under the same key meanwhile, the
+// new handler is closed and the existing one returned.
+func (c *handlerCache) add(key string, name string, handler *cachedHandler) *cachedHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		go handler.collector.Close()
+		return element.Value.(*cacheEntry).handler
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, name: name, handler: handler, lastUsed: time.Now()})
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back(), evictCapacity)
+	}
+	cacheEntries.Set(float64(c.order.Len()))
+	return handler
+}
+
+// removeIf drops the handlers for which drop returns true
+func (c *handlerCache) removeIf(drop func(*cachedHandler) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if drop(element.Value.(*cacheEntry).handler) {
+			c.remove(element, evictReload)
+		}
+		element = next
+	}
+	cacheEntries.Set(float64(c.order.Len()))
+}
+
+// expire drops the handlers unused for longer than the ttl. The least recently used entries are
+// at the back, so it stops at the first entry that is still fresh.
+func (c *handlerCache) expire(now time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+	for element := c.order.Back(); element != nil; element = c.order.Back() {
+		if now.Sub(element.Value.(*cacheEntry).lastUsed) <= c.ttl {
+			break
+		}
+		c.remove(element, evictExpired)
+	}
+	cacheEntries.Set(float64(c.order.Len()))
+}
+
+// expireLoop drops expired handlers in the background so that collectors of targets that are no
+// longer scraped stop polling
+func (c *handlerCache) expireLoop() {
+	if c.ttl <= 0 {
+		return
+	}
+	for now := range time.Tick(c.ttl / 2) {
+		c.mu.Lock()
+		c.expire(now)
+		c.mu.Unlock()
+	}
+}
+
+// remove drops an entry. It must be called with the lock held.
+func (c *handlerCache) remove(element *list.Element, reason string) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	cacheEvictions.WithLabelValues(reason).Inc()
+	logger.Info(fmt.Sprintf("Dropping handler for UPS `%s`", entry.name), "reason", reason)
+	go entry.handler.collector.Close()
+}
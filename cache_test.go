@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+func TestCacheKey(t *testing.T) {
+	opts := collectors.NutCollectorOpts{Server: "127.0.0.1", ServerPort: 3493, Variables: []string{"ups.status"}}
+	key := cacheKey("", opts)
+	if key != cacheKey("", opts) {
+		t.Error("equal options should have the same key")
+	}
+
+	changed := opts
+	changed.Variables = []string{"battery.charge"}
+	if key == cacheKey("", changed) {
+		t.Error("variables should be part of the key")
+	}
+	changed = opts
+	changed.Username = "monitor"
+	if key == cacheKey("", changed) {
+		t.Error("username should be part of the key")
+	}
+	if key == cacheKey("garage", opts) {
+		t.Error("target should be part of the key")
+	}
+}
+
+func TestHandlerCache(t *testing.T) {
+	newHandler := func() *cachedHandler {
+		return &cachedHandler{collector: &collectors.NutCollector{}}
+	}
+
+	cache := newHandlerCache(time.Minute, 2)
+	first, second := newHandler(), newHandler()
+	cache.add("a", "a", first)
+	cache.add("b", "b", second)
+	if cached := cache.add("a", "a", newHandler()); cached != first {
+		t.Error("adding an existing key should return the cached handler")
+	}
+
+	//a was used more recently, so b is dropped beyond two entries
+	cache.get("a")
+	cache.add("c", "c", newHandler())
+	if _, ok := cache.get("b"); ok {
+		t.Error("least recently used handler should have been evicted")
+	}
+	if cached, ok := cache.get("a"); !ok || cached != first {
+		t.Error("recently used handler should have been kept")
+	}
+
+	cache.expire(time.Now().Add(2 * time.Minute))
+	if _, ok := cache.get("a"); ok {
+		t.Error("expired handler should have been dropped")
+	}
+
+	cache.add("d", "d", first)
+	cache.removeIf(func(cached *cachedHandler) bool { return cached == first })
+	if _, ok := cache.get("d"); ok {
+		t.Error("handler should have been removed")
+	}
+}
@@ -0,0 +1,124 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+// How often the status of a tracked request is checked
+const trackingInterval = 250 * time.Millisecond
+
+// TrackingUnsupported is the status of requests sent to servers that can not track them
+const TrackingUnsupported = "UNTRACKED"
+
+// TrackedResult is the outcome of an instant command or set request
+type TrackedResult struct {
+	// TrackingID is empty if the server does not support tracking
+	TrackingID string
+	// Status is nutclient.TrackingSuccess, nutclient.TrackingPending if the request did not
+	// complete in time, TrackingUnsupported, or the error code reported by the driver. It is
+	// empty if the request was not accepted.
+	Status string
+}
+
+// RunCommand sends an instant command to the UPS with the credentials of the options and waits
+// for its result until ctx is done. An optional value is passed to commands that accept one.
+func RunCommand(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger, ups string, command string, value string) (TrackedResult, error) {
+	return runTracked(ctx, opts, logger, func(client *nutclient.Client) (string, error) {
+		if value != "" {
+			return client.RunCommand(ctx, ups, command, value)
+		}
+		return client.RunCommand(ctx, ups, command)
+	})
+}
+
+// runTracked sends a request on the shared session of the options with tracking enabled and
+// waits for the driver to report its result. The session is only held while talking to NUT so
+// that scrapes continue while waiting. Tracking IDs are known to upsd rather than to the session.
+func runTracked(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger, request func(*nutclient.Client) (string, error)) (TrackedResult, error) {
+	result := TrackedResult{}
+
+	conn := connections.get(&opts, logger)
+	var err error
+	result.TrackingID, err = sendTracked(ctx, conn, opts, logger, request)
+	if err != nil {
+		return result, err
+	}
+	if result.TrackingID == "" {
+		result.Status = TrackingUnsupported
+		return result, nil
+	}
+
+	ticker := time.NewTicker(trackingInterval)
+	defer ticker.Stop()
+	for {
+		status, err := getTracking(ctx, conn, result.TrackingID)
+		var nutErr *nutclient.Error
+		switch {
+		case errors.As(err, &nutErr):
+			//The driver rejected the request
+			result.Status = nutErr.Code
+			return result, nil
+		case err != nil && ctx.Err() != nil:
+			//Give up waiting, the request may still complete
+			result.Status = nutclient.TrackingPending
+			return result, nil
+		case err != nil:
+			return result, err
+		case status != nutclient.TrackingPending:
+			result.Status = status
+			return result, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			result.Status = nutclient.TrackingPending
+			return result, nil
+		}
+	}
+}
+
+// sendTracked enables tracking on the session and sends the request, returning its tracking ID
+func sendTracked(ctx context.Context, conn *nutConnection, opts NutCollectorOpts, logger *slog.Logger, request func(*nutclient.Client) (string, error)) (string, error) {
+	client, err := conn.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.release()
+
+	//Tracking is a setting of the session. Servers before NUT 2.8.0 do not know it.
+	if err := client.SetTracking(ctx, true); err != nil {
+		var nutErr *nutclient.Error
+		if !errors.As(err, &nutErr) {
+			conn.fail(err)
+			return "", err
+		}
+		logger.Debug("NUT server does not support tracking", "server", opts.Server, "err", err)
+	}
+
+	id, err := request(client)
+	if err != nil {
+		conn.fail(err)
+	}
+	return id, err
+}
+
+// getTracking reads the status of a tracked request on the shared session
+func getTracking(ctx context.Context, conn *nutConnection, id string) (string, error) {
+	client, err := conn.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.release()
+
+	status, err := client.GetTracking(ctx, id)
+	if err != nil {
+		conn.fail(err)
+	}
+	return status, err
+}
@@ -0,0 +1,47 @@
+package collectors
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+func TestRunCommandReleasesSession(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := newFakeUpsd(t, map[string][]string{
+		"SET TRACKING ON":           {"OK"},
+		"INSTCMD rack1 beeper.mute": {"OK TRACKING 1bd31808"},
+		"GET TRACKING 1bd31808":     {"PENDING"},
+	})
+	opts := server.opts()
+
+	done := make(chan TrackedResult)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		result, err := RunCommand(ctx, opts, logger, "rack1", "beeper.mute", "")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- result
+	}()
+
+	//Scrapes get the session while the driver has not reported the result
+	time.Sleep(3 * trackingInterval)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn := connections.get(&opts, logger)
+	if _, err := conn.acquire(ctx); err != nil {
+		t.Fatalf("session should be free while waiting for the driver: %s", err)
+	}
+	conn.release()
+
+	server.set("GET TRACKING 1bd31808", "SUCCESS")
+	if result := <-done; result.Status != nutclient.TrackingSuccess || result.TrackingID != "1bd31808" {
+		t.Errorf("unexpected result %#v", result)
+	}
+}
@@ -0,0 +1,338 @@
+package collectors
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+const (
+	// Sessions that were not used for this long are checked with a VER command before being reused
+	healthCheckInterval = 30 * time.Second
+	// Sessions that were not used for this long are logged out, which is checked every reapInterval
+	idleTimeout  = 10 * time.Minute
+	reapInterval = time.Minute
+	// Delays between reconnection attempts grow from minBackoff up to maxBackoff
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// Time allowed to log out before the connection is closed regardless
+	logoutTimeout = time.Second
+)
+
+// Stages of a scrape that errors are attributed to
+const (
+	stageConnect = "connect"
+	stageAuth    = "auth"
+	stageList    = "list"
+	stageGet     = "get"
+)
+
+var scrapeStages = []string{stageConnect, stageAuth, stageList, stageGet}
+
+// stageError is an error that occurred at a known stage of a scrape
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// errorStage returns the stage at which err occurred. Errors of unknown origin are attributed
+// to the connection.
+func errorStage(err error) string {
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return stageErr.stage
+	}
+	return stageConnect
+}
+
+// connections is shared by every collector so that all collectors targeting the same NUT server
+// as the same user share one authenticated session
+var connections = &connectionManager{
+	conns: make(map[string]*nutConnection),
+}
+
+type connectionManager struct {
+	mu    sync.Mutex
+	conns map[string]*nutConnection
+	// reaper starts logging out idle sessions in the background once the first one is requested
+	reaper sync.Once
+}
+
+// nutConnection is a persistent session to a NUT server. It may only be used by one collector at
+// a time between acquire and release.
+type nutConnection struct {
+	// lock is a semaphore rather than a mutex so that waiting for the session can be cancelled
+	lock       chan struct{}
+	server     string
+	port       int
+	username   string
+	password   string
+	opts       NutCollectorOpts
+	logger     *slog.Logger
+	client     *nutclient.Client
+	authErr    error
+	lastUsed   time.Time
+	failures   int
+	retryAfter time.Time
+
+	// requested is the last time get returned the session. It is guarded by the mutex of the
+	// connection manager rather than by lock.
+	requested time.Time
+}
+
+// get returns the shared session for the server, port and credentials of the options
+func (m *connectionManager) get(opts *NutCollectorOpts, logger *slog.Logger) *nutConnection {
+	key := fmt.Sprintf("%s:%d/%s:%s", opts.Server, opts.ServerPort, opts.Username, opts.Password)
+	if opts.TLS || opts.TLSRequired {
+		key = fmt.Sprintf("%s tls:%t,%s,%s,%s,%s,%t", key, opts.TLSRequired, opts.TLSCAFile, opts.TLSCertFile, opts.TLSKeyFile, opts.TLSServerName, opts.TLSInsecureSkipVerify)
+	}
+
+	m.reaper.Do(func() { go m.reapIdle() })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conn, ok := m.conns[key]
+	if !ok {
+		conn = &nutConnection{
+			server:   opts.Server,
+			port:     opts.ServerPort,
+			username: opts.Username,
+			password: opts.Password,
+			opts:     *opts,
+			logger:   logger,
+			lock:     make(chan struct{}, 1),
+			lastUsed: time.Now(),
+		}
+		m.conns[key] = conn
+	}
+	conn.requested = time.Now()
+	return conn
+}
+
+// reapIdle logs out of idle sessions every reapInterval
+func (m *connectionManager) reapIdle() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.reap()
+	}
+}
+
+// reap removes the sessions that were neither requested nor used for idleTimeout and logs out of
+// them. Sessions that are in use are never removed. Logging out happens after the manager is
+// unlocked so that it does not hold up scrapes of other sessions.
+func (m *connectionManager) reap() {
+	idle := []*nutConnection{}
+	m.mu.Lock()
+	for key, conn := range m.conns {
+		if time.Since(conn.requested) < idleTimeout {
+			continue
+		}
+		select {
+		case conn.lock <- struct{}{}:
+		default:
+			continue
+		}
+		if time.Since(conn.lastUsed) < idleTimeout {
+			<-conn.lock
+			continue
+		}
+		delete(m.conns, key)
+		idle = append(idle, conn)
+	}
+	m.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.logger.Debug("Closing idle NUT session", "server", conn.server, "port", conn.port)
+		conn.close()
+		<-conn.lock
+	}
+}
+
+// acquire locks the session and returns a connected and (if configured) authenticated client.
+// release must be called when done, unless an error is returned.
+func (n *nutConnection) acquire(ctx context.Context) (*nutclient.Client, error) {
+	select {
+	case n.lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, &stageError{stageConnect, fmt.Errorf("waiting for the session with %s:%d: %w", n.server, n.port, ctx.Err())}
+	}
+
+	if n.client != nil && time.Since(n.lastUsed) > healthCheckInterval {
+		if _, err := n.client.Version(ctx); err != nil {
+			n.logger.Info("Health check of NUT session failed, reconnecting", "server", n.server, "err", err)
+			n.close()
+		}
+	}
+
+	if n.client == nil {
+		if err := n.connect(ctx); err != nil {
+			<-n.lock
+			return nil, err
+		}
+	}
+
+	n.lastUsed = time.Now()
+	return n.client, nil
+}
+
+// release unlocks the session so it can be used by other collectors
+func (n *nutConnection) release() {
+	n.lastUsed = time.Now()
+	<-n.lock
+}
+
+// fail drops the session after an error so that the next acquire reconnects. Errors returned by
+// the NUT server itself leave the session usable and are ignored. It must be called between
+// acquire and release.
+func (n *nutConnection) fail(err error) {
+	var nutErr *nutclient.Error
+	if errors.As(err, &nutErr) {
+		return
+	}
+	n.logger.Debug("Dropping NUT session after error", "server", n.server, "err", err)
+	n.close()
+}
+
+// connect sets up the session. Failures delay the next attempt with an exponential backoff, except
+// when ctx ended because the scrape ran out of time.
+func (n *nutConnection) connect(ctx context.Context) error {
+	if time.Now().Before(n.retryAfter) {
+		return &stageError{stageConnect, fmt.Errorf("not reconnecting to %s:%d until %s after %d failed attempts", n.server, n.port, n.retryAfter.Format(time.RFC3339), n.failures)}
+	}
+
+	client, err := n.setup(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			n.failures++
+			backoff := minBackoff << (n.failures - 1)
+			if backoff > maxBackoff || backoff <= 0 {
+				backoff = maxBackoff
+			}
+			n.retryAfter = time.Now().Add(backoff)
+		}
+		return err
+	}
+	n.failures = 0
+	n.retryAfter = time.Time{}
+	n.client = client
+	return nil
+}
+
+// setup connects to the server, starts TLS and authenticates as configured
+func (n *nutConnection) setup(ctx context.Context) (*nutclient.Client, error) {
+	n.logger.Debug("Connecting to server", "server", n.server, "port", n.port)
+	client, err := nutclient.Dial(ctx, net.JoinHostPort(n.server, strconv.Itoa(n.port)))
+	if err != nil {
+		return nil, &stageError{stageConnect, err}
+	}
+	n.logger.Debug("Connected to server", "server", n.server)
+
+	if n.opts.TLS || n.opts.TLSRequired {
+		if err := n.startTLS(ctx, client); err != nil {
+			client.Close()
+			return nil, &stageError{stageConnect, err}
+		}
+	}
+
+	n.authErr = nil
+	if n.username != "" && n.password != "" {
+		err = client.Authenticate(ctx, n.username, n.password)
+		n.authErr = err
+		if err == nil {
+			n.logger.Debug("Authenticated", "server", n.server, "user", n.username)
+		} else {
+			n.logger.Warn("Failed to authenticate to NUT server", "server", n.server, "user", n.username, "err", err)
+			//Don't bail after logging the warning. Most NUT configurations do not require authn to read variables
+			var nutErr *nutclient.Error
+			if !errors.As(err, &nutErr) {
+				client.Close()
+				return nil, &stageError{stageAuth, err}
+			}
+		}
+	}
+	return client, nil
+}
+
+// startTLS upgrades the session to TLS. Unless TLS is required, a server that does not offer
+// STARTTLS is used in plain text.
+func (n *nutConnection) startTLS(ctx context.Context, client *nutclient.Client) error {
+	tlsConfig, err := buildTLSConfig(&n.opts)
+	if err != nil {
+		return err
+	}
+
+	err = client.StartTLS(ctx, tlsConfig)
+	if err == nil {
+		n.logger.Debug("Upgraded session to TLS", "server", n.server)
+		return nil
+	}
+
+	if !n.opts.TLSRequired && (nutclient.IsErrorCode(err, "FEATURE-NOT-SUPPORTED") || nutclient.IsErrorCode(err, "FEATURE-NOT-CONFIGURED")) {
+		n.logger.Warn("NUT server does not offer TLS, continuing in plain text", "server", n.server, "err", err)
+		return nil
+	}
+	return fmt.Errorf("failed to start TLS with %s: %w", n.server, err)
+}
+
+// buildTLSConfig loads the certificates named in the options. They are loaded on every connection
+// so that renewed certificates are picked up.
+func buildTLSConfig(opts *NutCollectorOpts) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         opts.TLSServerName,
+		InsecureSkipVerify: opts.TLSInsecureSkipVerify,
+	}
+
+	if opts.TLSCAFile != "" {
+		ca, err := os.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.TLSCAFile)
+		}
+	}
+
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+			return nil, fmt.Errorf("a client certificate requires both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (n *nutConnection) close() {
+	if n.client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+	n.client.Logout(ctx)
+	n.client.Close()
+	n.client = nil
+}
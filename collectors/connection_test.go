@@ -0,0 +1,77 @@
+package collectors
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestConnectBackoff(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	//A server without STARTTLS fails every attempt once TCP connected
+	server := newFakeUpsd(t, map[string][]string{})
+	opts := server.opts()
+	opts.TLSRequired = true
+	conn := connections.get(&opts, logger)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.acquire(context.Background()); err == nil {
+			t.Fatal("expected TLS to fail")
+		}
+	}
+	if accepted := server.accepted.Load(); accepted != 1 {
+		t.Errorf("failed setup should back off, want 1 connection, have %d", accepted)
+	}
+
+	//Scrapes running out of time are not the fault of the server
+	opts = server.opts()
+	opts.Username = "cancelled"
+	conn = connections.get(&opts, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := conn.acquire(ctx); err == nil {
+		t.Fatal("expected the cancelled acquire to fail")
+	}
+	if conn.failures != 0 || !conn.retryAfter.IsZero() {
+		t.Errorf("cancelled attempt should not back off, have %d failures until %s", conn.failures, conn.retryAfter.Format(time.RFC3339))
+	}
+}
+
+func TestReapIdleSessions(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := &connectionManager{conns: make(map[string]*nutConnection)}
+	server := newFakeUpsd(t, map[string][]string{})
+
+	sessions := []*nutConnection{}
+	for _, user := range []string{"idle", "busy", "recent"} {
+		opts := server.opts()
+		opts.Username = user
+		conn := manager.get(&opts, logger)
+		if _, err := conn.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if user != "busy" {
+			conn.release()
+		}
+		if user != "recent" {
+			conn.lastUsed = time.Now().Add(-2 * idleTimeout)
+			conn.requested = conn.lastUsed
+		}
+		sessions = append(sessions, conn)
+	}
+
+	manager.reap()
+	idle, busy, recent := sessions[0], sessions[1], sessions[2]
+	if idle.client != nil || len(manager.conns) != 2 {
+		t.Errorf("idle session should be logged out and removed, have %d sessions", len(manager.conns))
+	}
+	if busy.client == nil {
+		t.Error("session in use should be kept")
+	}
+	if recent.client == nil {
+		t.Error("recently used session should be kept")
+	}
+	busy.release()
+}
@@ -0,0 +1,53 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+// DiscoveredUPS is a UPS found on a NUT server
+type DiscoveredUPS struct {
+	Name        string
+	Description string
+	// Location is the value of device.location, if the UPS reports one
+	Location string
+}
+
+// DiscoverUPS lists the UPS devices of the NUT server of the options. If the options select a
+// UPS, only that UPS is returned.
+func DiscoverUPS(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger) ([]DiscoveredUPS, error) {
+	conn := connections.get(&opts, logger)
+	client, err := conn.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+
+	list, err := client.ListUPS(ctx)
+	if err != nil {
+		conn.fail(err)
+		return nil, err
+	}
+
+	result := []DiscoveredUPS{}
+	for _, ups := range list {
+		if opts.Ups != "" && ups.Name != opts.Ups {
+			continue
+		}
+		location, err := client.GetVariable(ctx, ups.Name, "device.location")
+		if err != nil {
+			//Most UPS devices do not report a location
+			var nutErr *nutclient.Error
+			if !errors.As(err, &nutErr) {
+				conn.fail(err)
+				return nil, err
+			}
+			location = ""
+		}
+		result = append(result, DiscoveredUPS{Name: ups.Name, Description: ups.Description, Location: location})
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package collectors
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeUpsd answers every request line found in responses with the given lines. Other requests
+// are answered with ERR UNKNOWN-COMMAND. Responses may be replaced while the server runs.
+type fakeUpsd struct {
+	listener net.Listener
+	// accepted counts the connections made to the server
+	accepted atomic.Int32
+
+	mu        sync.Mutex
+	responses map[string][]string
+	// requests counts the requests received, by request line
+	requests map[string]int
+}
+
+func newFakeUpsd(t *testing.T, responses map[string][]string) *fakeUpsd {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeUpsd{listener: listener, responses: responses, requests: make(map[string]int)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.accepted.Add(1)
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeUpsd) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "LOGOUT" {
+			conn.Write([]byte("OK Goodbye\n"))
+			return
+		}
+
+		s.mu.Lock()
+		response, ok := s.responses[line]
+		s.requests[line]++
+		s.mu.Unlock()
+		if !ok {
+			response = []string{"ERR UNKNOWN-COMMAND"}
+		}
+		for _, responseLine := range response {
+			conn.Write([]byte(responseLine + "\n"))
+		}
+	}
+}
+
+// set replaces the response to a request
+func (s *fakeUpsd) set(request string, response ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[request] = response
+}
+
+// received returns the number of times the request was received
+func (s *fakeUpsd) received(request string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[request]
+}
+
+// setVariables replaces the variables of a UPS, given as pairs of name and value
+func (s *fakeUpsd) setVariables(ups string, variables ...string) {
+	response := []string{"BEGIN LIST VAR " + ups}
+	for i := 0; i+1 < len(variables); i += 2 {
+		response = append(response, fmt.Sprintf("VAR %s %s %q", ups, variables[i], variables[i+1]))
+	}
+	s.set("LIST VAR "+ups, append(response, "END LIST VAR "+ups)...)
+}
+
+// opts returns collector options for the server
+func (s *fakeUpsd) opts() NutCollectorOpts {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return NutCollectorOpts{
+		Namespace:  "network_ups_tools",
+		Server:     addr.IP.String(),
+		ServerPort: addr.Port,
+	}
+}
@@ -1,23 +1,193 @@
 package collectors
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"path"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
-	nut "github.com/robbiet480/go.nut"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+// DefaultDeviceLabels are the labels of device_info. Names without a dot are read from device.NAME.
+var DefaultDeviceLabels = []string{"model", "mfr", "serial", "type", "description", "contact", "location", "part", "macaddr"}
+
+// Labels used by the metrics of the collector that identity labels must not collide with
+var reservedLabels = []string{"ups", "flag", "variable", "value", "command", "client", "result", "stage"}
+
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// deviceLabel is a label of device_info and the variable it is read from
+type deviceLabel struct {
+	name     string
+	variable string
+}
+
+var numberRegex = regexp.MustCompile(`^-?[0-9\.]+$`)
+
+// Values of NutCollectorOpts.VariableOutput
+const (
+	// VariableOutputPerVariable exports every variable as its own metric named after the variable
+	VariableOutputPerVariable = "per-variable"
+	// VariableOutputGeneric exports all variables as one variable metric with a variable label
+	VariableOutputGeneric = "generic"
+	// VariableOutputBoth exports variables both ways
+	VariableOutputBoth = "both"
 )
 
-var deviceLabels = []string{"model", "mfr", "serial", "type", "description", "contact", "location", "part", "macaddr"}
+// VariableOutputs lists the valid values of NutCollectorOpts.VariableOutput
+var VariableOutputs = []string{VariableOutputPerVariable, VariableOutputGeneric, VariableOutputBoth}
 
 type NutCollector struct {
-	deviceDesc *prometheus.Desc
-	logger     *slog.Logger
-	opts       *NutCollectorOpts
-	onRegex    *regexp.Regexp
-	offRegex   *regexp.Regexp
+	deviceDesc   *prometheus.Desc
+	deviceLabels []deviceLabel
+	tlsDesc      *prometheus.Desc
+	timeoutDesc  *prometheus.Desc
+	logger       *slog.Logger
+	opts         *NutCollectorOpts
+	onRegex      *regexp.Regexp
+	offRegex     *regexp.Regexp
+
+	// Only set if the generic variable output is enabled
+	variableDesc     *prometheus.Desc
+	variableInfoDesc *prometheus.Desc
+
+	// Only set if the inventory is enabled
+	commandDesc  *prometheus.Desc
+	writableDesc *prometheus.Desc
+
+	// Only set if client metrics are enabled
+	clientsDesc    *prometheus.Desc
+	clientInfoDesc *prometheus.Desc
+
+	mappings       map[string][]valueMapping
+	unmappedValues *prometheus.CounterVec
+
+	// Health of the scrapes of this collector, exported whether or not NUT could be read
+	upDesc        *prometheus.Desc
+	durationDesc  *prometheus.Desc
+	variablesDesc *prometheus.Desc
+	lastSuccess   prometheus.Gauge
+	scrapeErrors  *prometheus.CounterVec
+
+	// Only set in polling mode
+	poller  *poller
+	ageDesc *prometheus.Desc
+
+	// Variable descriptions never change, so they are only requested from NUT once
+	descriptionsMu sync.Mutex
+	descriptions   map[string]string
+
+	// ups is the configured UPS or the only UPS found by an earlier scrape. Cached collectors are
+	// scraped concurrently, so it is guarded rather than kept in opts.
+	upsMu sync.Mutex
+	ups   string
+}
+
+// nutUPS holds what was read from NUT about one UPS during a scrape
+type nutUPS struct {
+	Name        string
+	Description string
+	Variables   []nutVariable
+	// Commands and Writable are only read if the inventory is enabled
+	Commands []string
+	Writable []string
+	// Clients and Logins are only read if client metrics are enabled. Logins is -1 if unknown.
+	Clients []string
+	Logins  int
+}
+
+type nutVariable struct {
+	Name        string
+	Value       interface{}
+	Raw         string
+	Description string
+}
+
+// ValueMapping maps the string values of a variable that match exactly, or match a regular
+// expression, to a number
+type ValueMapping struct {
+	Match string  `yaml:"match"`
+	Regex string  `yaml:"regex"`
+	Value float64 `yaml:"value"`
+}
+
+// Validate checks that exactly one of Match and Regex is set and that Regex compiles
+func (m ValueMapping) Validate() error {
+	if (m.Match == "") == (m.Regex == "") {
+		return fmt.Errorf("either match or regex must be set")
+	}
+	if m.Regex != "" {
+		if _, err := regexp.Compile(m.Regex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueMapping is a ValueMapping with its regular expression compiled
+type valueMapping struct {
+	match string
+	regex *regexp.Regexp
+	value float64
+}
+
+// compileMappings checks and compiles the mappings of every variable
+func compileMappings(mappings map[string][]ValueMapping) (map[string][]valueMapping, error) {
+	result := make(map[string][]valueMapping, len(mappings))
+	for variable, variableMappings := range mappings {
+		for _, mapping := range variableMappings {
+			if err := mapping.Validate(); err != nil {
+				return nil, fmt.Errorf("mapping of %s: %w", variable, err)
+			}
+			compiled := valueMapping{match: mapping.Match, value: mapping.Value}
+			if mapping.Regex != "" {
+				compiled.regex = regexp.MustCompile(mapping.Regex)
+			}
+			result[variable] = append(result[variable], compiled)
+		}
+	}
+	return result, nil
+}
+
+// mapValue returns the number of the first mapping matching value
+func mapValue(mappings []valueMapping, value string) (float64, bool) {
+	for _, mapping := range mappings {
+		if mapping.regex != nil && mapping.regex.MatchString(value) {
+			return mapping.value, true
+		}
+		if mapping.regex == nil && mapping.match == value {
+			return mapping.value, true
+		}
+	}
+	return 0, false
+}
+
+// infoLimiter caps the number of info series with string values exported by one scrape
+type infoLimiter struct {
+	max     int
+	emitted int
+	dropped int
+}
+
+// allow reports whether another info series may be exported
+func (l *infoLimiter) allow() bool {
+	if l.max > 0 && l.emitted >= l.max {
+		l.dropped++
+		return false
+	}
+	l.emitted++
+	return true
 }
 
 type NutCollectorOpts struct {
@@ -32,19 +202,175 @@ type NutCollectorOpts struct {
 	OnRegex           string
 	OffRegex          string
 	DisableDeviceInfo bool
+	MultiUps          bool
+	// DeviceLabels are the labels of device_info and default to DefaultDeviceLabels. Names without
+	// a dot are read from device.NAME, others such as ups.firmware from the variable of that name
+	// with dots replaced by underscores in the label name.
+	DeviceLabels []string
+	// IdentityLabels are device labels that are added to every metric read from the UPS
+	IdentityLabels []string
+	// VariableOutput is one of VariableOutputs and defaults to VariableOutputPerVariable
+	VariableOutput string
+	// MetricNaming is one of MetricNamings and defaults to MetricNamingLegacy. It applies to the
+	// metrics named after variables.
+	MetricNaming string
+	// CounterVariables are patterns of variables that only ever increase. They are exported as
+	// NAME_total counters with any naming, in addition to the gauge with legacy naming.
+	CounterVariables []string
+	// StringVariables are exported as NAME_info metrics with the value in a label. Values are
+	// truncated to StringMaxLength characters and at most StringMaxSeries info series are exported
+	// per scrape. Zero disables a limit.
+	StringVariables []string
+	StringMaxLength int
+	StringMaxSeries int
+	// DateVariables are exported as NAME_timestamp_seconds and DurationVariables as NAME_seconds
+	DateVariables     []string
+	DurationVariables []string
+	// Mappings convert the string values of variables to numbers before the on/off regular
+	// expressions are tried. Mapped variables are always exported.
+	Mappings map[string][]ValueMapping
+	// Inventory exports the instant commands and writable variables supported by the UPS
+	Inventory bool
+	// Clients exports the number of clients logged in to the UPS and their addresses
+	Clients bool
+
+	// PollInterval enables polling mode. NUT is read in the background at this interval and
+	// scrapes are served the latest successful snapshot until it is older than PollMaxAge, which
+	// defaults to three intervals. Collectors in polling mode must be closed.
+	PollInterval time.Duration
+	PollMaxAge   time.Duration
+
+	// TLS attempts to upgrade the session with STARTTLS. TLSRequired fails the scrape if upsd refuses.
+	TLS                   bool
+	TLSRequired           bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
 }
 
-func NewNutCollector(opts NutCollectorOpts, logger *slog.Logger) (*NutCollector, error) {
+// NewNutCollector creates a collector for the options. If a UPS is selected, its name is checked
+// against the NUT server for as long as ctx allows.
+func NewNutCollector(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger) (*NutCollector, error) {
+	if opts.DeviceLabels == nil {
+		opts.DeviceLabels = DefaultDeviceLabels
+	}
+	deviceLabels, err := parseDeviceLabels(opts.DeviceLabels, opts.IdentityLabels)
+	if err != nil {
+		return nil, err
+	}
+	deviceLabelNames := upsLabelNames(opts)
+	for _, label := range deviceLabels {
+		if !sliceContains(opts.IdentityLabels, label.name) {
+			deviceLabelNames = append(deviceLabelNames, label.name)
+		}
+	}
 	deviceDesc := prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "device_info"),
 		"UPS Device information",
-		deviceLabels, nil,
+		deviceLabelNames, nil,
 	)
 	if opts.DisableDeviceInfo {
 		deviceDesc = nil
 	}
 
+	tlsDesc := prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "tls_enabled"),
+		"Whether the session with the NUT server is encrypted with TLS",
+		nil, nil,
+	)
+
+	timeoutDesc := prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "scrape_timeout"),
+		"Whether the scrape of the NUT server was cut short by the scrape timeout, leaving a partial result",
+		nil, nil,
+	)
+
+	scrapeErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: opts.Namespace,
+		Name:      "scrape_errors_total",
+		Help:      "Errors while scraping the NUT server by the stage of the scrape they occurred at",
+	}, []string{"stage"})
+	for _, stage := range scrapeStages {
+		scrapeErrors.WithLabelValues(stage)
+	}
+
+	var variableDesc, variableInfoDesc *prometheus.Desc
+	switch opts.VariableOutput {
+	case "":
+		opts.VariableOutput = VariableOutputPerVariable
+	case VariableOutputPerVariable:
+	case VariableOutputGeneric, VariableOutputBoth:
+		variableDesc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "variable"),
+			"Value of a numeric NUT variable",
+			append(upsLabelNames(opts), "variable"), nil,
+		)
+		variableInfoDesc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "variable_info"),
+			"Value of a NUT variable that is not a number",
+			append(upsLabelNames(opts), "variable", "value"), nil,
+		)
+	default:
+		return nil, fmt.Errorf("invalid variable output %q, must be one of %s", opts.VariableOutput, strings.Join(VariableOutputs, ", "))
+	}
+
+	var commandDesc, writableDesc *prometheus.Desc
+	if opts.Inventory {
+		commandDesc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "command_info"),
+			"Instant command supported by the UPS",
+			append(upsLabelNames(opts), "command"), nil,
+		)
+		writableDesc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "variable_writable"),
+			"Variable of the UPS that can be set remotely",
+			append(upsLabelNames(opts), "variable"), nil,
+		)
+	}
+
+	var clientsDesc, clientInfoDesc *prometheus.Desc
+	if opts.Clients {
+		clientsDesc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "clients_connected"),
+			"Number of clients, such as upsmon, logged in to the UPS",
+			upsLabelNames(opts), nil,
+		)
+		clientInfoDesc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "client_info"),
+			"Address of a client logged in to the UPS",
+			append(upsLabelNames(opts), "client"), nil,
+		)
+	}
+
+	switch opts.MetricNaming {
+	case "":
+		opts.MetricNaming = MetricNamingLegacy
+	case MetricNamingLegacy, MetricNamingConventional, MetricNamingBoth:
+	default:
+		return nil, fmt.Errorf("invalid metric naming %q, must be one of %s", opts.MetricNaming, strings.Join(MetricNamings, ", "))
+	}
+
+	for _, pattern := range opts.CounterVariables {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid counter variable pattern %q: %w", pattern, err)
+		}
+	}
+
+	mappings, err := compileMappings(opts.Mappings)
+	if err != nil {
+		return nil, err
+	}
+	unmappedValues := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: opts.Namespace,
+		Name:      "unmapped_values_total",
+		Help:      "Values of variables with mappings that matched none of the mappings",
+	}, append(upsLabelNames(opts), "variable"))
+	if len(upsLabelNames(opts)) == 0 {
+		for variable := range mappings {
+			unmappedValues.WithLabelValues(variable)
+		}
+	}
+
 	var onRegex, offRegex *regexp.Regexp
-	var err error
+
+	if opts.TLS || opts.TLSRequired {
+		if _, err := buildTLSConfig(&opts); err != nil {
+			return nil, err
+		}
+	}
 
 	if opts.OnRegex != "" {
 		onRegex, err = regexp.Compile(fmt.Sprintf("(?i)%s", opts.OnRegex))
@@ -61,15 +387,52 @@ func NewNutCollector(opts NutCollectorOpts, logger *slog.Logger) (*NutCollector,
 	}
 
 	collector := &NutCollector{
-		deviceDesc: deviceDesc,
-		logger:     logger,
-		opts:       &opts,
-		onRegex:    onRegex,
-		offRegex:   offRegex,
+		deviceDesc:   deviceDesc,
+		deviceLabels: deviceLabels,
+		tlsDesc:      tlsDesc,
+		timeoutDesc:  timeoutDesc,
+		logger:       logger,
+		opts:         &opts,
+		onRegex:      onRegex,
+		offRegex:     offRegex,
+
+		variableDesc:     variableDesc,
+		variableInfoDesc: variableInfoDesc,
+
+		commandDesc:  commandDesc,
+		writableDesc: writableDesc,
+
+		clientsDesc:    clientsDesc,
+		clientInfoDesc: clientInfoDesc,
+
+		mappings:       mappings,
+		unmappedValues: unmappedValues,
+
+		upDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "up"),
+			"Whether the variables of the UPS devices were read from the NUT server",
+			nil, nil,
+		),
+		durationDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "scrape_duration_seconds"),
+			"Time taken to scrape the NUT server",
+			nil, nil,
+		),
+		variablesDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "variables_exported"),
+			"Number of NUT variables exported by the scrape",
+			nil, nil,
+		),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time of the last scrape that read the NUT server successfully",
+		}),
+		scrapeErrors: scrapeErrors,
+
+		descriptions: make(map[string]string),
+		ups:          opts.Ups,
 	}
 
 	if opts.Ups != "" {
-		valid, err := collector.IsValidUPSName(opts.Ups)
+		valid, err := collector.IsValidUPSName(ctx, opts.Ups)
 		if err != nil {
 			logger.Warn("Error detected while verifying UPS name - proceeding without validation", "error", err)
 		} else if !valid {
@@ -77,119 +440,205 @@ func NewNutCollector(opts NutCollectorOpts, logger *slog.Logger) (*NutCollector,
 		}
 	}
 
+	if opts.PollInterval > 0 {
+		collector.startPolling()
+	}
+
 	logger.Info("collector configured", "variables", strings.Join(collector.opts.Variables, ","))
 	return collector, nil
 }
 
+// contextCollector binds a NutCollector to the context of one scrape
+type contextCollector struct {
+	ctx       context.Context
+	collector *NutCollector
+}
+
+// WithContext returns a collector that cancels all NUT requests of its scrapes when ctx is done
+func (c *NutCollector) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{ctx: ctx, collector: c}
+}
+
+func (c *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+func (c *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collector.CollectContext(c.ctx, ch)
+}
+
 func (c *NutCollector) Collect(ch chan<- prometheus.Metric) {
-	c.logger.Debug("Connecting to server", "server", c.opts.Server, "port", c.opts.ServerPort)
-	client, err := nut.Connect(c.opts.Server, c.opts.ServerPort)
+	c.CollectContext(context.Background(), ch)
+}
+
+// CollectContext collects the metrics of the UPS devices. If ctx is done before NUT answered,
+// whatever was read until then is exported along with scrape_timeout set to 1. Errors are reported
+// through the up and scrape_errors_total metrics rather than failing the scrape. In polling mode,
+// the latest snapshot is exported instead of reading NUT.
+func (c *NutCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if c.poller != nil {
+		c.collectSnapshot(ctx, ch)
+	} else {
+		c.collectNUT(ctx, ch)
+	}
+	ch <- c.lastSuccess
+	c.scrapeErrors.Collect(ch)
+}
+
+// collectNUT reads the NUT server and sends the metrics of the UPS devices along with the
+// outcome of the read. It reports whether the read succeeded.
+func (c *NutCollector) collectNUT(ctx context.Context, ch chan<- prometheus.Metric) bool {
+	start := time.Now()
+	exported, err := c.collectUPS(ctx, ch)
+
+	up := float64(0)
 	if err != nil {
-		c.logger.Error("failed connecting to server", "err", err)
-		ch <- prometheus.NewInvalidMetric(
-			prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", "error"),
-				"Failure gathering UPS variables", nil, nil),
-			err)
-		return
-	}
-
-	defer client.Disconnect()
-	c.logger.Debug("Connected to server", "server", c.opts.Server)
-
-	if c.opts.Username != "" && c.opts.Password != "" {
-		_, err = client.Authenticate(c.opts.Username, c.opts.Password)
-		if err == nil {
-			c.logger.Debug("Authenticated", "server", c.opts.Server, "user", c.opts.Username)
-		} else {
-			c.logger.Warn("Failed to authenticate to NUT server", "server", c.opts.Server, "user", c.opts.Username)
-			//Don't bail after logging the warning. Most NUT configurations do not require authn to read variables
-		}
-	}
-
-	upsList := []nut.UPS{}
-	if c.opts.Ups != "" {
-		ups, err := nut.NewUPS(c.opts.Ups, &client)
-		if err == nil {
-			c.logger.Debug("Instantiated UPS", "name", c.opts.Ups)
-			upsList = append(upsList, ups)
-		} else {
-			c.logger.Error("Failure instantiating the UPS", "name", c.opts.Ups, "err", err)
-			ch <- prometheus.NewInvalidMetric(
-				prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", "error"),
-					"Failure instantiating the UPS", nil, nil),
-				err)
-			return
-		}
+		c.scrapeErrors.WithLabelValues(errorStage(err)).Inc()
 	} else {
-		tmp, err := client.GetUPSList()
-		if err == nil {
-			c.logger.Debug("Obtained list of UPS devices")
-			upsList = tmp
-			for _, ups := range tmp {
-				c.logger.Debug("UPS name detection", "name", ups.Name)
-			}
-		} else {
-			c.logger.Error("Failure getting the list of UPS devices", "err", err)
-			ch <- prometheus.NewInvalidMetric(
-				prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", "error"),
-					"Failure getting the list of UPS devices", nil, nil),
-				err)
-			return
-		}
+		up = 1
+		c.lastSuccess.SetToCurrentTime()
+	}
+
+	timedOut := float64(0)
+	if err != nil && ctx.Err() != nil {
+		timedOut = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(c.timeoutDesc, prometheus.GaugeValue, timedOut)
+	ch <- prometheus.MustNewConstMetric(c.durationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+	ch <- prometheus.MustNewConstMetric(c.variablesDesc, prometheus.GaugeValue, float64(exported))
+	if len(c.mappings) > 0 {
+		c.unmappedValues.Collect(ch)
+	}
+	return err == nil
+}
+
+// collectUPS reads the UPS devices from NUT and sends their metrics. It returns the number of
+// variables exported and the error that ended the scrape early, if any.
+func (c *NutCollector) collectUPS(ctx context.Context, ch chan<- prometheus.Metric) (int, error) {
+	//Variables may be exported in several forms, but each is counted once
+	exported := make(map[string]bool)
+	conn := connections.get(c.opts, c.logger)
+	client, err := conn.acquire(ctx)
+	if err != nil && ctx.Err() != nil {
+		c.logger.Warn("Scrape timed out before connecting to server", "server", c.opts.Server, "err", err)
+		return len(exported), err
+	}
+	if err != nil {
+		c.logger.Error("failed connecting to server", "err", err)
+		return len(exported), err
+	}
+	if conn.authErr != nil {
+		//The session continues unauthenticated, which is enough to read variables
+		c.scrapeErrors.WithLabelValues(stageAuth).Inc()
+	}
+
+	tlsEnabled := float64(0)
+	if client.TLS() {
+		tlsEnabled = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.tlsDesc, prometheus.GaugeValue, tlsEnabled)
+
+	//Everything is read up front so the session is not held while metrics are built
+	c.upsMu.Lock()
+	upsName := c.ups
+	c.upsMu.Unlock()
+	upsList, err := c.fetchUPSList(ctx, client, upsName)
+	if err != nil {
+		conn.fail(err)
+	}
+	conn.release()
+
+	if err != nil && ctx.Err() != nil {
+		c.logger.Warn("Scrape timed out, exporting a partial result", "server", c.opts.Server, "ups_read", len(upsList), "err", err)
+	} else if err != nil {
+		return len(exported), err
 	}
 
-	if len(upsList) > 1 {
+	if len(upsList) > 1 && !c.opts.MultiUps {
 		c.logger.Error("Multiple UPS devices were found by NUT for this scrape. For this configuration, you MUST scrape this exporter with a query string parameter indicating which UPS to scrape. Valid values of ups are:")
 		for _, ups := range upsList {
 			c.logger.Error(ups.Name)
 		}
-		ch <- prometheus.NewInvalidMetric(
-			prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", "error"),
-				"Multiple UPS devices were found from NUT. Please add a ups=<name> query string", nil, nil),
-			err)
-		return
-	} else if len(upsList) == 1 {
+		return len(exported), &stageError{stageList, fmt.Errorf("multiple UPS devices were found from NUT, add a ups=<name> query string or enable multi UPS mode")}
+	} else if len(upsList) == 1 && !c.opts.MultiUps && err == nil {
 		//Set the name so subsequent scrapes don't have to look it up
-		c.opts.Ups = upsList[0].Name
+		c.upsMu.Lock()
+		c.ups = upsList[0].Name
+		c.upsMu.Unlock()
 	}
 
-	for _, ups := range upsList {
-		device := make(map[string]string)
-		for _, label := range deviceLabels {
-			device[label] = ""
+	limiter := &infoLimiter{max: c.opts.StringMaxSeries}
+	defer func() {
+		if limiter.dropped > 0 {
+			c.logger.Warn("Dropped info series with string values over the limit", "limit", limiter.max, "dropped", limiter.dropped)
 		}
+	}()
 
-		c.logger.Debug(
-			"UPS info",
-			"name", ups.Name,
-			"description", ups.Description,
-			"master", ups.Master,
-			"nmumber_of_logins", ups.NumberOfLogins,
-		)
-		for i, clientName := range ups.Clients {
-			c.logger.Debug(fmt.Sprintf("client %d", i), "name", clientName)
+	for _, ups := range upsList {
+		device := c.deviceValues(ups)
+
+		/* In multi UPS mode, every metric carries the name of the UPS it came from, followed by the identity labels */
+		upsLabels := upsLabelNames(*c.opts)
+		upsLabelValues := []string{}
+		if c.opts.MultiUps {
+			upsLabelValues = []string{ups.Name}
 		}
-		for _, command := range ups.Commands {
-			c.logger.Debug("ups command", "command", command.Name, "description", command.Description)
+		for _, label := range c.opts.IdentityLabels {
+			upsLabelValues = append(upsLabelValues, device[label])
 		}
+
 		for _, variable := range ups.Variables {
 			c.logger.Debug(
 				"Variable dump",
 				"variable_name", variable.Name,
 				"value", variable.Value,
-				"type", variable.Type,
+				"type", fmt.Sprintf("%T", variable.Value),
 				"description", variable.Description,
-				"writeable", variable.Writeable,
-				"maximum_length", variable.MaximumLength,
-				"original_type", variable.OriginalType,
 			)
-			path := strings.Split(variable.Name, ".")
-			if path[0] == "device" {
-				device[path[1]] = fmt.Sprintf("%v", variable.Value)
+			/* Strings that are requested as such keep their raw value, even if they look like numbers */
+			isString := sliceContains(c.opts.StringVariables, variable.Name)
+			if isString && c.opts.VariableOutput != VariableOutputGeneric && limiter.allow() {
+				infoDesc := prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", metricName(variable.Name)+"_info"),
+					fmt.Sprintf("%s (%s)", variable.Description, variable.Name),
+					append(upsLabels, "value"), nil,
+				)
+				ch <- prometheus.MustNewConstMetric(infoDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, c.labelValue(variable.Raw))...)
+				exported[ups.Name+" "+variable.Name] = true
+			}
+			if isString && c.variableInfoDesc != nil && limiter.allow() {
+				ch <- prometheus.MustNewConstMetric(c.variableInfoDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, variable.Name, c.labelValue(variable.Raw))...)
+				exported[ups.Name+" "+variable.Name] = true
+			}
+
+			if sliceContains(c.opts.DateVariables, variable.Name) {
+				if date, err := parseDate(variable.Raw); err == nil {
+					dateDesc := prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", metricName(variable.Name)+"_timestamp_seconds"),
+						fmt.Sprintf("%s (%s)", variable.Description, variable.Name),
+						upsLabels, nil,
+					)
+					ch <- prometheus.MustNewConstMetric(dateDesc, prometheus.GaugeValue, float64(date.Unix()), upsLabelValues...)
+					exported[ups.Name+" "+variable.Name] = true
+				} else {
+					c.logger.Debug("Cannot parse date variable", "name", variable.Name, "err", err)
+				}
+			}
+			if sliceContains(c.opts.DurationVariables, variable.Name) && !c.hasConventionalName(variable) {
+				if duration, err := parseDuration(variable.Raw); err == nil {
+					durationDesc := prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", metricName(variable.Name)+"_seconds"),
+						fmt.Sprintf("%s (%s)", variable.Description, variable.Name),
+						upsLabels, nil,
+					)
+					ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, duration.Seconds(), upsLabelValues...)
+					exported[ups.Name+" "+variable.Name] = true
+				} else {
+					c.logger.Debug("Cannot parse duration variable", "name", variable.Name, "err", err)
+				}
 			}
 
 			/* Done special processing - now get as general as possible and gather all requested or number-like metrics */
-			if len(c.opts.Variables) == 0 || sliceContains(c.opts.Variables, variable.Name) {
+			if c.isExported(variable.Name) {
 				c.logger.Debug("Export the variable? true")
 				value := float64(0)
 
@@ -198,12 +647,12 @@ func (c *NutCollector) Collect(ch chan<- prometheus.Metric) {
 					setStatuses := make(map[string]bool)
 					varDesc := prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", strings.Replace(variable.Name, ".", "_", -1)),
 						fmt.Sprintf("%s (%s)", variable.Description, variable.Name),
-						[]string{"flag"}, nil,
+						append(upsLabels, "flag"), nil,
 					)
 
 					for _, statusFlag := range strings.Split(variable.Value.(string), " ") {
 						setStatuses[statusFlag] = true
-						ch <- prometheus.MustNewConstMetric(varDesc, prometheus.GaugeValue, float64(1), statusFlag)
+						ch <- prometheus.MustNewConstMetric(varDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, statusFlag)...)
 					}
 
 					/* If the user specifies the statues that must always be set, handle that here */
@@ -213,32 +662,39 @@ func (c *NutCollector) Collect(ch chan<- prometheus.Metric) {
 							if _, ok := setStatuses[status]; ok {
 								continue
 							}
-							ch <- prometheus.MustNewConstMetric(varDesc, prometheus.GaugeValue, float64(0), status)
+							ch <- prometheus.MustNewConstMetric(varDesc, prometheus.GaugeValue, float64(0), append(upsLabelValues, status)...)
 						}
 					}
+					if c.variableInfoDesc != nil && !isString && limiter.allow() {
+						ch <- prometheus.MustNewConstMetric(c.variableInfoDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, variable.Name, c.labelValue(variable.Raw))...)
+					}
+					exported[ups.Name+" "+variable.Name] = true
 					continue
 				}
 
-				/* This is overkill - the library only deals with bool, string, int64 and float64 */
+				/* Mappings take precedence over the on/off regular expressions */
+				if mappings, ok := c.mappings[variable.Name]; ok {
+					if mapped, ok := mapValue(mappings, variable.Raw); ok {
+						c.logger.Debug("Converted string due to mapping", "value", variable.Raw, "mapped", mapped)
+						variable.Value = mapped
+					} else {
+						c.logger.Debug("No mapping matched the value", "name", variable.Name, "value", variable.Raw)
+						c.unmappedValues.WithLabelValues(append(upsLabelValues, variable.Name)...).Inc()
+					}
+				}
+
+				/* parseValue only deals with bool, string, int64 and float64 */
 				switch v := variable.Value.(type) {
 				case bool:
 					if v {
 						value = float64(1)
 					}
-				case int:
-					value = float64(v)
-				case int8:
-					value = float64(v)
-				case int16:
-					value = float64(v)
 				case int64:
 					value = float64(v)
-				case float32:
-					value = float64(v)
 				case float64:
 					value = float64(v)
 				case string:
-					/* All numbers should be coaxed to native types by the library, so see if we can figure out
+					/* All numbers should be coaxed to native types by parseValue, so see if we can figure out
 					   if this string could possible represent a binary value
 					*/
 					if c.onRegex != nil && c.onRegex.MatchString(variable.Value.(string)) {
@@ -249,46 +705,421 @@ func (c *NutCollector) Collect(ch chan<- prometheus.Metric) {
 						value = float64(0)
 					} else {
 						c.logger.Debug("Cannot convert string to binary 0/1", "value", variable.Value.(string))
+						if c.variableInfoDesc != nil && !isString && limiter.allow() {
+							ch <- prometheus.MustNewConstMetric(c.variableInfoDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, variable.Name, c.labelValue(v))...)
+							exported[ups.Name+" "+variable.Name] = true
+						}
 						continue
 					}
 				default:
-					c.logger.Warn("Unknown variable type from nut client library", "name", variable.Name, "type", fmt.Sprintf("%T", v), "claimed_type", variable.Type, "value", v)
+					c.logger.Warn("Unknown variable type", "name", variable.Name, "type", fmt.Sprintf("%T", v), "value", v)
 					continue
 				}
 
-				name := strings.ReplaceAll(variable.Name, ".", "_")
-				name = strings.ReplaceAll(name, "-", "_")
+				conventional, valueType, known := c.conventionalMetric(variable)
+				if c.opts.VariableOutput != VariableOutputGeneric && (c.opts.MetricNaming != MetricNamingConventional || !known) {
+					fqName := prometheus.BuildFQName(c.opts.Namespace, "", metricName(variable.Name))
+					varDesc := prometheus.NewDesc(fqName,
+						fmt.Sprintf("%s (%s)", variable.Description, variable.Name),
+						upsLabels, nil,
+					)
 
-				fqName := prometheus.BuildFQName(c.opts.Namespace, "", name)
-				varDesc := prometheus.NewDesc(fqName,
-					fmt.Sprintf("%s (%s)", variable.Description, variable.Name),
-					nil, nil,
-				)
+					c.logger.Debug("Collecting as prometheus metric", "name", fqName, "value", value)
+					ch <- prometheus.MustNewConstMetric(varDesc, prometheus.GaugeValue, value, upsLabelValues...)
+				}
+				//Counters are typed as such whatever the naming, legacy naming only keeps the gauge as well
+				if c.opts.VariableOutput != VariableOutputGeneric && known && (c.opts.MetricNaming != MetricNamingLegacy || valueType == prometheus.CounterValue) {
+					fqName := prometheus.BuildFQName(c.opts.Namespace, "", conventional.name)
+					varDesc := prometheus.NewDesc(fqName,
+						fmt.Sprintf("%s (%s)", conventional.help, variable.Name),
+						upsLabels, nil,
+					)
 
-				c.logger.Debug("Collecting as prometheus metric", "name", fqName, "value", value)
-				ch <- prometheus.MustNewConstMetric(varDesc, prometheus.GaugeValue, value)
+					c.logger.Debug("Collecting as prometheus metric", "name", fqName, "value", value*conventional.scale)
+					ch <- prometheus.MustNewConstMetric(varDesc, valueType, value*conventional.scale, upsLabelValues...)
+				}
+				if c.variableDesc != nil {
+					ch <- prometheus.MustNewConstMetric(c.variableDesc, prometheus.GaugeValue, value, append(upsLabelValues, variable.Name)...)
+				}
+				exported[ups.Name+" "+variable.Name] = true
 			} else {
 				c.logger.Debug("Export the variable? false", "count", len(c.opts.Variables), "variables", strings.Join(c.opts.Variables, ","))
 			}
 		}
 
+		if c.commandDesc != nil {
+			for _, command := range ups.Commands {
+				ch <- prometheus.MustNewConstMetric(c.commandDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, command)...)
+			}
+			for _, variable := range ups.Writable {
+				ch <- prometheus.MustNewConstMetric(c.writableDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, variable)...)
+			}
+		}
+
+		if c.clientsDesc != nil {
+			if ups.Logins >= 0 {
+				ch <- prometheus.MustNewConstMetric(c.clientsDesc, prometheus.GaugeValue, float64(ups.Logins), upsLabelValues...)
+			}
+			for _, client := range ups.Clients {
+				ch <- prometheus.MustNewConstMetric(c.clientInfoDesc, prometheus.GaugeValue, float64(1), append(upsLabelValues, client)...)
+			}
+		}
+
 		// Only provide device info if not disabled
 		if !c.opts.DisableDeviceInfo {
-			deviceValues := []string{}
-			for _, label := range deviceLabels {
-				deviceValues = append(deviceValues, device[label])
+			deviceValues := append([]string{}, upsLabelValues...)
+			for _, label := range c.deviceLabels {
+				if !sliceContains(c.opts.IdentityLabels, label.name) {
+					deviceValues = append(deviceValues, device[label.name])
+				}
 			}
 			ch <- prometheus.MustNewConstMetric(c.deviceDesc, prometheus.GaugeValue, float64(1), deviceValues...)
 		}
 	}
+	return len(exported), err
+}
+
+// fetchUPSList reads either the given UPS or, if the name is empty, all UPS devices known to the
+// NUT server. On error, the UPS devices that were read completely are returned along with the error.
+func (c *NutCollector) fetchUPSList(ctx context.Context, client *nutclient.Client, upsName string) ([]nutUPS, error) {
+	upsList := []nutUPS{}
+	if upsName != "" {
+		upsList = append(upsList, nutUPS{Name: upsName})
+	} else {
+		tmp, err := client.ListUPS(ctx)
+		if err != nil {
+			c.logger.Error("Failure getting the list of UPS devices", "err", err)
+			return nil, &stageError{stageList, fmt.Errorf("failure getting the list of UPS devices: %w", err)}
+		}
+		c.logger.Debug("Obtained list of UPS devices")
+		for _, ups := range tmp {
+			c.logger.Debug("UPS name detection", "name", ups.Name)
+			upsList = append(upsList, nutUPS{Name: ups.Name, Description: ups.Description})
+		}
+		if len(upsList) > 1 && !c.opts.MultiUps {
+			//The scrape fails anyway, so don't bother reading the variables
+			return upsList, nil
+		}
+	}
+
+	for i := range upsList {
+		ups := &upsList[i]
+		variables, err := client.ListVariables(ctx, ups.Name)
+		if err != nil {
+			c.logger.Error("Failure instantiating the UPS", "name", ups.Name, "err", err)
+			return upsList[:i], &stageError{stageList, fmt.Errorf("failure instantiating the UPS: %w", err)}
+		}
+		c.logger.Debug("Instantiated UPS", "name", ups.Name)
+
+		for _, variable := range variables {
+			description := ""
+			if c.isRequested(variable.Name) {
+				description, err = c.describe(ctx, client, ups.Name, variable.Name)
+				if err != nil {
+					return upsList[:i], &stageError{stageGet, fmt.Errorf("failure getting the description of %s: %w", variable.Name, err)}
+				}
+			}
+			ups.Variables = append(ups.Variables, nutVariable{
+				Name:        variable.Name,
+				Value:       parseValue(variable.Value),
+				Raw:         variable.Value,
+				Description: description,
+			})
+		}
+
+		if c.opts.Inventory {
+			if err := c.fetchInventory(ctx, client, ups); err != nil {
+				return upsList[:i], err
+			}
+		}
+
+		if c.opts.Clients {
+			if err := c.fetchClients(ctx, client, ups); err != nil {
+				return upsList[:i], err
+			}
+		}
+
+		if c.logger.Enabled(ctx, slog.LevelDebug) {
+			c.logUPSDetails(ups)
+		}
+	}
+	return upsList, nil
+}
+
+// skipError logs and counts the error of a request the scrape can do without and reports whether
+// the session is still usable, which is the case for ERR responses and for malformed replies that
+// were read completely. Other errors mean the session broke and end the scrape.
+func (c *NutCollector) skipError(err error, stage string, msg string, args ...any) bool {
+	var nutErr *nutclient.Error
+	var numErr *strconv.NumError
+	if !errors.As(err, &nutErr) && !errors.As(err, &numErr) {
+		return false
+	}
+	c.logger.Debug(msg, append(args, "err", err)...)
+	c.scrapeErrors.WithLabelValues(stage).Inc()
+	return true
+}
+
+// fetchInventory reads the instant commands and writable variables of the UPS. Skipped errors
+// leave the inventory empty.
+func (c *NutCollector) fetchInventory(ctx context.Context, client *nutclient.Client, ups *nutUPS) error {
+	commands, err := client.ListCommands(ctx, ups.Name)
+	if err != nil && !c.skipError(err, stageList, "Failure listing commands", "name", ups.Name) {
+		return &stageError{stageList, fmt.Errorf("failure listing the commands of %s: %w", ups.Name, err)}
+	}
+	ups.Commands = commands
+
+	writable, err := client.ListWritable(ctx, ups.Name)
+	if err != nil && !c.skipError(err, stageList, "Failure listing writable variables", "name", ups.Name) {
+		return &stageError{stageList, fmt.Errorf("failure listing the writable variables of %s: %w", ups.Name, err)}
+	}
+	for _, variable := range writable {
+		ups.Writable = append(ups.Writable, variable.Name)
+	}
+	return nil
+}
+
+// fetchClients reads the number of logins to the UPS and the addresses of the clients. Skipped
+// errors leave the clients unknown.
+func (c *NutCollector) fetchClients(ctx context.Context, client *nutclient.Client, ups *nutUPS) error {
+	logins, err := client.GetNumLogins(ctx, ups.Name)
+	ups.Logins = logins
+	if err != nil {
+		if !c.skipError(err, stageGet, "Failure getting the number of logins", "name", ups.Name) {
+			return &stageError{stageGet, fmt.Errorf("failure getting the number of logins to %s: %w", ups.Name, err)}
+		}
+		ups.Logins = -1
+	}
+
+	clients, err := client.ListClients(ctx, ups.Name)
+	if err != nil && !c.skipError(err, stageList, "Failure listing clients", "name", ups.Name) {
+		return &stageError{stageList, fmt.Errorf("failure listing the clients of %s: %w", ups.Name, err)}
+	}
+	//Several clients may log in from the same address
+	slices.Sort(clients)
+	ups.Clients = slices.Compact(clients)
+	return nil
+}
+
+// describe returns the description of a variable, asking NUT only the first time. Skipped errors
+// leave the description empty, while a broken session is tried again on the next scrape.
+func (c *NutCollector) describe(ctx context.Context, client *nutclient.Client, ups string, variable string) (string, error) {
+	c.descriptionsMu.Lock()
+	defer c.descriptionsMu.Unlock()
+
+	if description, ok := c.descriptions[variable]; ok {
+		return description, nil
+	}
+
+	description, err := client.GetDescription(ctx, ups, variable)
+	if err != nil && !c.skipError(err, stageGet, "Failure getting the description of a variable", "name", variable) {
+		return "", err
+	}
+	c.descriptions[variable] = description
+	return description, nil
+}
+
+// logUPSDetails logs information about the UPS that is not exported for troubleshooting. Only
+// what the scrape read anyway is logged, so that debug logging does not add requests to NUT.
+func (c *NutCollector) logUPSDetails(ups *nutUPS) {
+	if c.opts.Clients {
+		c.logger.Debug("UPS info", "name", ups.Name, "number_of_logins", ups.Logins)
+		for i, clientName := range ups.Clients {
+			c.logger.Debug(fmt.Sprintf("client %d", i), "name", clientName)
+		}
+	}
+
+	if c.opts.Inventory {
+		for _, command := range ups.Commands {
+			c.logger.Debug("ups command", "command", command)
+		}
+		for _, variable := range ups.Writable {
+			c.logger.Debug("writable variable", "variable_name", variable)
+		}
+	}
+}
+
+// parseValue coaxes a value returned by NUT to a bool, int64 or float64 where possible
+func parseValue(value string) interface{} {
+	switch value {
+	case "enabled":
+		return true
+	case "disabled":
+		return false
+	}
+
+	if numberRegex.MatchString(value) {
+		if strings.Count(value, ".") == 1 {
+			if converted, err := strconv.ParseFloat(value, 64); err == nil {
+				return converted
+			}
+		} else if converted, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return converted
+		}
+	}
+	return value
 }
 
 func (c *NutCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.tlsDesc
+	ch <- c.timeoutDesc
+	ch <- c.durationDesc
+	ch <- c.variablesDesc
+	ch <- c.lastSuccess.Desc()
+	if c.ageDesc != nil {
+		ch <- c.ageDesc
+	}
+	if c.variableDesc != nil {
+		ch <- c.variableDesc
+		ch <- c.variableInfoDesc
+	}
+	if c.commandDesc != nil {
+		ch <- c.commandDesc
+		ch <- c.writableDesc
+	}
+	if c.clientsDesc != nil {
+		ch <- c.clientsDesc
+		ch <- c.clientInfoDesc
+	}
+	c.scrapeErrors.Describe(ch)
+	if len(c.mappings) > 0 {
+		c.unmappedValues.Describe(ch)
+	}
 	if !c.opts.DisableDeviceInfo {
 		ch <- c.deviceDesc
 	}
 }
 
+// metricName turns the name of a NUT variable into a metric name
+func metricName(variable string) string {
+	name := strings.ReplaceAll(variable, ".", "_")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// labelValue makes a string read from NUT safe to use as a label value and truncates it to the
+// configured length
+func (c *NutCollector) labelValue(value string) string {
+	value = strings.ToValidUTF8(value, "\uFFFD")
+	if c.opts.StringMaxLength > 0 && utf8.RuneCountInString(value) > c.opts.StringMaxLength {
+		value = string([]rune(value)[:c.opts.StringMaxLength])
+	}
+	return value
+}
+
+// conventionalMetric returns how the variable is exported with conventional naming, if it is a
+// counter or has a known unit
+func (c *NutCollector) conventionalMetric(variable nutVariable) (conventionalMetric, prometheus.ValueType, bool) {
+	if c.isCounter(variable.Name) {
+		return conventionalMetric{metricName(variable.Name) + "_total", variable.Description, 1}, prometheus.CounterValue, true
+	}
+	metric, known := conventionalMetrics[variable.Name]
+	return metric, prometheus.GaugeValue, known
+}
+
+// isCounter reports whether the variable matches one of the counter patterns
+func (c *NutCollector) isCounter(name string) bool {
+	for _, pattern := range c.opts.CounterVariables {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConventionalName reports whether the variable is exported with a conventional name, which
+// already carries the unit
+func (c *NutCollector) hasConventionalName(variable nutVariable) bool {
+	if _, _, known := c.conventionalMetric(variable); !known {
+		return false
+	}
+	if _, isString := variable.Value.(string); isString {
+		return false
+	}
+	return c.opts.MetricNaming != MetricNamingLegacy && c.opts.VariableOutput != VariableOutputGeneric && c.isExported(variable.Name)
+}
+
+// isRequested reports whether the variable is exported in any form
+func (c *NutCollector) isRequested(name string) bool {
+	return c.isExported(name) ||
+		sliceContains(c.opts.StringVariables, name) ||
+		sliceContains(c.opts.DateVariables, name) ||
+		sliceContains(c.opts.DurationVariables, name)
+}
+
+// isExported reports whether the variable was requested to be exported
+func (c *NutCollector) isExported(name string) bool {
+	if _, ok := c.mappings[name]; ok {
+		return true
+	}
+	return len(c.opts.Variables) == 0 || sliceContains(c.opts.Variables, name)
+}
+
+// upsLabelNames returns the labels identifying the UPS a metric belongs to
+func upsLabelNames(opts NutCollectorOpts) []string {
+	labels := []string{}
+	if opts.MultiUps {
+		labels = append(labels, "ups")
+	}
+	return append(labels, opts.IdentityLabels...)
+}
+
+// ValidateDeviceLabels checks the device and identity labels of NutCollectorOpts. Nil labels
+// stand for DefaultDeviceLabels.
+func ValidateDeviceLabels(labels []string, identityLabels []string) error {
+	if labels == nil {
+		labels = DefaultDeviceLabels
+	}
+	_, err := parseDeviceLabels(labels, identityLabels)
+	return err
+}
+
+// parseDeviceLabels resolves the variables of the device labels and checks that every identity
+// label is one of them
+func parseDeviceLabels(labels []string, identityLabels []string) ([]deviceLabel, error) {
+	result := []deviceLabel{}
+	names := make(map[string]bool)
+	for _, entry := range labels {
+		label := deviceLabel{name: entry, variable: "device." + entry}
+		if strings.Contains(entry, ".") {
+			label = deviceLabel{name: metricName(strings.TrimPrefix(entry, "device.")), variable: entry}
+		}
+		if !labelNameRegex.MatchString(label.name) || label.name == "ups" {
+			return nil, fmt.Errorf("invalid device label %q", entry)
+		}
+		if names[label.name] {
+			return nil, fmt.Errorf("duplicate device label %q", label.name)
+		}
+		names[label.name] = true
+		result = append(result, label)
+	}
+
+	for _, name := range identityLabels {
+		if !names[name] {
+			return nil, fmt.Errorf("identity label %q is not one of the device labels", name)
+		}
+		if sliceContains(reservedLabels, name) {
+			return nil, fmt.Errorf("identity label %q is reserved", name)
+		}
+	}
+	return result, nil
+}
+
+// deviceValues returns the values of the device labels of the UPS. Labels of variables the UPS
+// does not have are empty.
+func (c *NutCollector) deviceValues(ups nutUPS) map[string]string {
+	raw := make(map[string]string, len(ups.Variables))
+	for _, variable := range ups.Variables {
+		raw[variable.Name] = variable.Raw
+	}
+
+	values := make(map[string]string, len(c.deviceLabels))
+	for _, label := range c.deviceLabels {
+		values[label.name] = strings.ToValidUTF8(raw[label.variable], "\uFFFD")
+	}
+	return values
+}
+
 func sliceContains(c []string, value string) bool {
 	for _, sliceValue := range c {
 		if sliceValue == value {
@@ -298,28 +1129,21 @@ func sliceContains(c []string, value string) bool {
 	return false
 }
 
-func (c *NutCollector) IsValidUPSName(upsName string) (bool, error) {
+func (c *NutCollector) IsValidUPSName(ctx context.Context, upsName string) (bool, error) {
 	result := false
 
-	c.logger.Debug(fmt.Sprintf("Connecting to server and verifying `%s` is a valid UPS name", upsName), "server", c.opts.Server)
-	client, err := nut.Connect(c.opts.Server)
+	c.logger.Debug(fmt.Sprintf("Verifying `%s` is a valid UPS name", upsName), "server", c.opts.Server)
+	conn := connections.get(c.opts, c.logger)
+	client, err := conn.acquire(ctx)
 	if err != nil {
 		c.logger.Error("error while connecting to server", "err", err)
 		return result, err
 	}
+	defer conn.release()
 
-	defer client.Disconnect()
-
-	if c.opts.Username != "" && c.opts.Password != "" {
-		_, err = client.Authenticate(c.opts.Username, c.opts.Password)
-		if err != nil {
-			c.logger.Warn("Failed to authenticate to NUT server", "server", c.opts.Server, "user", c.opts.Username)
-			//Don't bail after logging the warning. Most NUT configurations do not require authn to get the UPS list
-		}
-	}
-
-	tmp, err := client.GetUPSList()
+	tmp, err := client.ListUPS(ctx)
 	if err != nil {
+		conn.fail(err)
 		c.logger.Error("Failure getting the list of UPS devices", "err", err)
 		return result, err
 	}
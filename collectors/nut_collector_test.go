@@ -0,0 +1,529 @@
+package collectors
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestUpsd returns a NUT server with two UPS devices
+func newTestUpsd(t *testing.T) *fakeUpsd {
+	return newFakeUpsd(t, map[string][]string{
+		"LIST UPS": {
+			"BEGIN LIST UPS",
+			`UPS rack1 "Rack 1 UPS"`,
+			`UPS rack2 "Rack 2 UPS"`,
+			"END LIST UPS",
+		},
+		"LIST VAR rack1": {
+			"BEGIN LIST VAR rack1",
+			`VAR rack1 battery.charge "100"`,
+			`VAR rack1 ups.status "OL CHRG"`,
+			`VAR rack1 device.model "Smart-UPS 1500"`,
+			`VAR rack1 device.location "DC1"`,
+			"END LIST VAR rack1",
+		},
+		"LIST VAR rack2": {
+			"BEGIN LIST VAR rack2",
+			`VAR rack2 battery.charge "97"`,
+			`VAR rack2 ups.status "OB"`,
+			`VAR rack2 device.model "Eaton 5P"`,
+			"END LIST VAR rack2",
+		},
+		"GET DESC rack1 battery.charge": {`DESC rack1 battery.charge "Battery charge (percent of full)"`},
+		"GET DESC rack1 ups.status":     {`DESC rack1 ups.status "UPS status"`},
+		"GET NUMLOGINS rack1":           {"NUMLOGINS rack1 1"},
+		"GET NUMLOGINS rack2":           {"NUMLOGINS rack2 0"},
+		"LIST CLIENT rack1": {
+			"BEGIN LIST CLIENT rack1",
+			"CLIENT rack1 10.0.0.5",
+			"END LIST CLIENT rack1",
+		},
+		"LIST CLIENT rack2": {
+			"BEGIN LIST CLIENT rack2",
+			"END LIST CLIENT rack2",
+		},
+	})
+}
+
+// testOpts returns options exporting battery.charge and ups.status of the server
+func testOpts(server *fakeUpsd) NutCollectorOpts {
+	opts := server.opts()
+	opts.Variables = []string{"battery.charge", "ups.status"}
+	opts.Statuses = []string{"OL", "OB"}
+	return opts
+}
+
+func newTestCollector(t *testing.T, opts NutCollectorOpts) *NutCollector {
+	t.Helper()
+	collector, err := NewNutCollector(context.Background(), opts, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(collector.Close)
+	return collector
+}
+
+// scrape collects the series of the collector, keyed by name and labels such as
+// network_ups_tools_up or network_ups_tools_battery_charge{ups="rack1"}
+func scrape(t *testing.T, collector prometheus.Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := []string{}
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+`="`+label.GetValue()+`"`)
+			}
+			sort.Strings(labels)
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			switch {
+			case metric.Gauge != nil:
+				series[name] = metric.GetGauge().GetValue()
+			case metric.Counter != nil:
+				series[name] = metric.GetCounter().GetValue()
+			default:
+				series[name] = metric.GetUntyped().GetValue()
+			}
+		}
+	}
+	return series
+}
+
+// metricTypes returns the type of each metric family of the collector, such as GAUGE or COUNTER
+func metricTypes(t *testing.T, collector prometheus.Collector) map[string]string {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]string)
+	for _, family := range families {
+		types[family.GetName()] = family.GetType().String()
+	}
+	return types
+}
+
+// expectSeries checks the values of series and that series mapped to -1 are absent
+func expectSeries(t *testing.T, series map[string]float64, want map[string]float64) {
+	t.Helper()
+	for name, value := range want {
+		have, ok := series[name]
+		switch {
+		case value == -1 && ok:
+			t.Errorf("%s: expected no series, have %v", name, have)
+		case value != -1 && !ok:
+			t.Errorf("%s: missing", name)
+		case value != -1 && have != value:
+			t.Errorf("%s: want %v, have %v", name, value, have)
+		}
+	}
+}
+
+func TestClientsMalformedLogins(t *testing.T) {
+	server := newTestUpsd(t)
+	server.set("GET NUMLOGINS rack1", "NUMLOGINS rack1 many")
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+	opts.Clients = true
+	collector := newTestCollector(t, opts)
+
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_up":                               1,
+		"network_ups_tools_battery_charge":                   100,
+		"network_ups_tools_clients_connected":                -1,
+		`network_ups_tools_client_info{client="10.0.0.5"}`:   1,
+		`network_ups_tools_scrape_errors_total{stage="get"}`: 1,
+	})
+	if accepted := server.accepted.Load(); accepted != 1 {
+		t.Errorf("malformed number of logins should keep the session, have %d connections", accepted)
+	}
+}
+
+func TestDebugLoggingRequests(t *testing.T) {
+	server := newTestUpsd(t)
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+	opts.Clients = true
+	opts.Inventory = true
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	collector, err := NewNutCollector(context.Background(), opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The details logged at debug level are the ones the scrape read anyway
+	scrape(t, collector)
+	for _, request := range []string{"GET NUMLOGINS rack1", "LIST CLIENT rack1", "LIST CMD rack1", "LIST RW rack1"} {
+		if received := server.received(request); received != 1 {
+			t.Errorf("%s: want 1 request, have %d", request, received)
+		}
+	}
+}
+func TestMultiUps(t *testing.T) {
+	server := newTestUpsd(t)
+	opts := testOpts(server)
+	opts.MultiUps = true
+	collector := newTestCollector(t, opts)
+
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_up":                                   1,
+		`network_ups_tools_battery_charge{ups="rack1"}`:          100,
+		`network_ups_tools_battery_charge{ups="rack2"}`:          97,
+		`network_ups_tools_ups_status{flag="OL",ups="rack1"}`:    1,
+		`network_ups_tools_ups_status{flag="OB",ups="rack1"}`:    0,
+		`network_ups_tools_ups_status{flag="OB",ups="rack2"}`:    1,
+		"network_ups_tools_battery_charge":                       -1,
+		`network_ups_tools_scrape_errors_total{stage="list"}`:    0,
+		`network_ups_tools_scrape_errors_total{stage="connect"}`: 0,
+	})
+}
+
+func TestScrapeFailure(t *testing.T) {
+	t.Run("several UPS devices without a UPS name", func(t *testing.T) {
+		server := newTestUpsd(t)
+		collector := newTestCollector(t, testOpts(server))
+
+		expectSeries(t, scrape(t, collector), map[string]float64{
+			"network_ups_tools_up":                                0,
+			"network_ups_tools_battery_charge":                    -1,
+			`network_ups_tools_scrape_errors_total{stage="list"}`: 1,
+		})
+	})
+
+	t.Run("error reply", func(t *testing.T) {
+		server := newTestUpsd(t)
+		server.set("LIST VAR rack2", "ERR DRIVER-NOT-CONNECTED")
+		opts := testOpts(server)
+		opts.Ups = "rack2"
+		collector := newTestCollector(t, opts)
+
+		for i := 1; i <= 2; i++ {
+			expectSeries(t, scrape(t, collector), map[string]float64{
+				"network_ups_tools_up":                                0,
+				"network_ups_tools_battery_charge":                    -1,
+				`network_ups_tools_scrape_errors_total{stage="list"}`: float64(i),
+			})
+		}
+	})
+
+	t.Run("server down", func(t *testing.T) {
+		server := newTestUpsd(t)
+		server.listener.Close()
+		opts := testOpts(server)
+		opts.Ups = "rack1"
+		collector := newTestCollector(t, opts)
+
+		expectSeries(t, scrape(t, collector), map[string]float64{
+			"network_ups_tools_up":                                   0,
+			"network_ups_tools_battery_charge":                       -1,
+			`network_ups_tools_scrape_errors_total{stage="connect"}`: 1,
+		})
+	})
+}
+
+func TestPollingMaxAge(t *testing.T) {
+	server := newTestUpsd(t)
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+	opts.PollInterval = 20 * time.Millisecond
+	opts.PollMaxAge = 400 * time.Millisecond
+	collector := newTestCollector(t, opts)
+
+	series := scrape(t, collector)
+	expectSeries(t, series, map[string]float64{
+		"network_ups_tools_up":             1,
+		"network_ups_tools_battery_charge": 100,
+	})
+	if age, ok := series["network_ups_tools_snapshot_age_seconds"]; !ok || age > opts.PollMaxAge.Seconds() {
+		t.Errorf("snapshot_age_seconds: want a fresh snapshot, have %v (present %t)", age, ok)
+	}
+
+	//Failed polls keep the variables of the previous snapshot until it is too old, but not up
+	server.set("LIST VAR rack1", "ERR DRIVER-NOT-CONNECTED")
+	time.Sleep(3 * opts.PollInterval)
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_up":             0,
+		"network_ups_tools_battery_charge": 100,
+	})
+
+	time.Sleep(opts.PollMaxAge)
+	series = scrape(t, collector)
+	expectSeries(t, series, map[string]float64{
+		"network_ups_tools_up":             0,
+		"network_ups_tools_battery_charge": -1,
+	})
+	if age := series["network_ups_tools_snapshot_age_seconds"]; age <= opts.PollMaxAge.Seconds() {
+		t.Errorf("snapshot_age_seconds: want an age over the max age, have %v", age)
+	}
+	if errors := series[`network_ups_tools_scrape_errors_total{stage="list"}`]; errors == 0 {
+		t.Error("scrape_errors_total: failed polls should be counted")
+	}
+}
+
+func TestConcurrentScrapes(t *testing.T) {
+	server := newTestUpsd(t)
+	server.set("LIST UPS", "BEGIN LIST UPS", `UPS rack1 "Rack 1 UPS"`, "END LIST UPS")
+	collector := newTestCollector(t, testOpts(server))
+
+	//Cached collectors are shared by concurrent scrapes, the first of which looks up the UPS name
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan prometheus.Metric)
+			go func() {
+				collector.Collect(ch)
+				close(ch)
+			}()
+			for range ch {
+			}
+		}()
+	}
+	wg.Wait()
+
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_up":             1,
+		"network_ups_tools_battery_charge": 100,
+	})
+}
+
+func TestCounterVariables(t *testing.T) {
+	server := newTestUpsd(t)
+	server.set("LIST VAR rack1",
+		"BEGIN LIST VAR rack1",
+		`VAR rack1 battery.charge "100"`,
+		`VAR rack1 battery.charger.cycles "12"`,
+		"END LIST VAR rack1",
+	)
+
+	for naming, want := range map[string]map[string]string{
+		MetricNamingLegacy: {
+			"network_ups_tools_battery_charger_cycles":       "GAUGE",
+			"network_ups_tools_battery_charger_cycles_total": "COUNTER",
+			"network_ups_tools_battery_charge":               "GAUGE",
+		},
+		MetricNamingConventional: {
+			"network_ups_tools_battery_charger_cycles":       "",
+			"network_ups_tools_battery_charger_cycles_total": "COUNTER",
+			"network_ups_tools_battery_charge_ratio":         "GAUGE",
+		},
+	} {
+		opts := server.opts()
+		opts.Ups = "rack1"
+		opts.MetricNaming = naming
+		opts.CounterVariables = DefaultCounterVariables
+		collector := newTestCollector(t, opts)
+
+		types := metricTypes(t, collector)
+		for name, wantType := range want {
+			if types[name] != wantType {
+				t.Errorf("%s naming: %s: want type %q, have %q", naming, name, wantType, types[name])
+			}
+		}
+		expectSeries(t, scrape(t, collector), map[string]float64{
+			"network_ups_tools_battery_charger_cycles_total": 12,
+		})
+	}
+}
+
+func TestGenericVariableOutput(t *testing.T) {
+	server := newTestUpsd(t)
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+	opts.Variables = nil
+	opts.VariableOutput = VariableOutputGeneric
+	collector := newTestCollector(t, opts)
+
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		`network_ups_tools_variable{variable="battery.charge"}`:                           100,
+		`network_ups_tools_variable_info{value="Smart-UPS 1500",variable="device.model"}`: 1,
+		`network_ups_tools_variable_info{value="OL CHRG",variable="ups.status"}`:          1,
+		"network_ups_tools_battery_charge":                                                -1,
+		`network_ups_tools_variable{variable="device.model"}`:                             -1,
+		"network_ups_tools_variables_exported":                                            4,
+	})
+}
+
+func TestStringVariables(t *testing.T) {
+	server := newTestUpsd(t)
+	server.setVariables("rack1",
+		"battery.type", "PbAc",
+		"ups.firmware", "UPS 08.8 (ID18)",
+		"driver.name", "usbhid-ups",
+	)
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+	opts.StringVariables = []string{"battery.type", "ups.firmware", "driver.name"}
+	opts.StringMaxLength = 8
+	opts.StringMaxSeries = 2
+	collector := newTestCollector(t, opts)
+
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		`network_ups_tools_battery_type_info{value="PbAc"}`:     1,
+		`network_ups_tools_ups_firmware_info{value="UPS 08.8"}`: 1,
+		`network_ups_tools_driver_name_info{value="usbhid-u"}`:  -1,
+		"network_ups_tools_battery_type":                        -1,
+	})
+}
+
+func TestValueMappings(t *testing.T) {
+	server := newTestUpsd(t)
+	server.setVariables("rack1",
+		"ups.test.result", "Done and passed",
+		"ups.beeper.status", "muted",
+		"input.transfer.reason", "input voltage out of range",
+	)
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+	opts.OnRegex = "^(enabled|muted)$"
+	opts.Mappings = map[string][]ValueMapping{
+		"ups.test.result":       {{Match: "Done and passed", Value: 1}, {Regex: "^Aborted", Value: 3}},
+		"ups.beeper.status":     {{Match: "enabled", Value: 1}, {Match: "disabled", Value: 0}},
+		"input.transfer.reason": {{Regex: "(?i)VOLTAGE", Value: 2}},
+	}
+	collector := newTestCollector(t, opts)
+
+	series := scrape(t, collector)
+	expectSeries(t, series, map[string]float64{
+		"network_ups_tools_ups_test_result":                                         1,
+		"network_ups_tools_input_transfer_reason":                                   2,
+		`network_ups_tools_unmapped_values_total{variable="ups.test.result"}`:       0,
+		`network_ups_tools_unmapped_values_total{variable="ups.beeper.status"}`:     1,
+		`network_ups_tools_unmapped_values_total{variable="input.transfer.reason"}`: 0,
+		// Values no mapping matched fall back to the on/off regular expressions
+		"network_ups_tools_ups_beeper_status": 1,
+	})
+
+	server.setVariables("rack1", "ups.test.result", "Aborted by the user")
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_ups_test_result": 3,
+	})
+}
+
+func TestConventionalNaming(t *testing.T) {
+	server := newTestUpsd(t)
+	server.setVariables("rack1",
+		"battery.charge", "50",
+		"battery.runtime", "1800",
+		"input.voltage", "230.5",
+		"driver.parameter.pollinterval", "2",
+	)
+
+	for naming, want := range map[string]map[string]float64{
+		MetricNamingConventional: {
+			"network_ups_tools_battery_charge_ratio":          0.5,
+			"network_ups_tools_battery_runtime_seconds":       1800,
+			"network_ups_tools_input_voltage_volts":           230.5,
+			"network_ups_tools_battery_charge":                -1,
+			"network_ups_tools_driver_parameter_pollinterval": 2,
+		},
+		MetricNamingBoth: {
+			"network_ups_tools_battery_charge_ratio":    0.5,
+			"network_ups_tools_battery_charge":          50,
+			"network_ups_tools_battery_runtime_seconds": 1800,
+			"network_ups_tools_battery_runtime":         1800,
+		},
+	} {
+		opts := testOpts(server)
+		opts.Ups = "rack1"
+		opts.Variables = nil
+		opts.MetricNaming = naming
+		collector := newTestCollector(t, opts)
+		expectSeries(t, scrape(t, collector), want)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	server := newTestUpsd(t)
+	server.set("LIST CMD rack1",
+		"BEGIN LIST CMD rack1",
+		"CMD rack1 test.battery.start.quick",
+		"CMD rack1 beeper.mute",
+		"END LIST CMD rack1",
+	)
+	server.set("LIST RW rack1",
+		"BEGIN LIST RW rack1",
+		`RW rack1 input.transfer.high "264"`,
+		"END LIST RW rack1",
+	)
+	opts := testOpts(server)
+	opts.MultiUps = true
+	opts.Inventory = true
+	collector := newTestCollector(t, opts)
+
+	//rack2 answers LIST CMD and LIST RW with errors, which leave its inventory empty
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_up": 1,
+		`network_ups_tools_command_info{command="test.battery.start.quick",ups="rack1"}`:  1,
+		`network_ups_tools_command_info{command="beeper.mute",ups="rack1"}`:               1,
+		`network_ups_tools_variable_writable{ups="rack1",variable="input.transfer.high"}`: 1,
+		`network_ups_tools_variable_writable{ups="rack1",variable="battery.charge"}`:      -1,
+		`network_ups_tools_scrape_errors_total{stage="list"}`:                             2,
+	})
+}
+
+func TestDeviceLabels(t *testing.T) {
+	server := newTestUpsd(t)
+	server.setVariables("rack1",
+		"battery.charge", "100",
+		"ups.status", "OL",
+		"device", "ups",
+		"device.model", "Smart-UPS 1500",
+		"device.location", "DC1",
+		"ups.firmware", "UPS 08.8",
+	)
+
+	t.Run("defaults", func(t *testing.T) {
+		opts := testOpts(server)
+		opts.Ups = "rack1"
+		collector := newTestCollector(t, opts)
+
+		expectSeries(t, scrape(t, collector), map[string]float64{
+			`network_ups_tools_device_info{contact="",description="",location="DC1",macaddr="",mfr="",model="Smart-UPS 1500",part="",serial="",type=""}`: 1,
+		})
+	})
+
+	t.Run("identity labels", func(t *testing.T) {
+		opts := testOpts(server)
+		opts.Ups = "rack1"
+		opts.DeviceLabels = []string{"model", "location", "ups.firmware"}
+		opts.IdentityLabels = []string{"location"}
+		collector := newTestCollector(t, opts)
+
+		expectSeries(t, scrape(t, collector), map[string]float64{
+			`network_ups_tools_device_info{location="DC1",model="Smart-UPS 1500",ups_firmware="UPS 08.8"}`: 1,
+			`network_ups_tools_battery_charge{location="DC1"}`:                                             100,
+			`network_ups_tools_ups_status{flag="OL",location="DC1"}`:                                       1,
+			"network_ups_tools_battery_charge":                                                             -1,
+			"network_ups_tools_up":                                                                         1,
+		})
+	})
+}
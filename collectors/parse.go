@@ -0,0 +1,59 @@
+package collectors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayouts are the date formats found in NUT variables such as battery.date. Drivers
+// disagree on the format, and the NUT documentation has changed from mm/dd/yy to YYYY/MM/DD.
+var dateLayouts = []string{
+	"2006/01/02",
+	"2006-01-02",
+	"2006/1/2",
+	"01/02/06",
+	"01/02/2006",
+	"1/2/06",
+	"1/2/2006",
+	"20060102",
+}
+
+// parseDate parses a date reported by NUT as midnight UTC
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown date format %q", value)
+}
+
+// parseDuration parses a duration reported by NUT. Plain numbers are seconds, and values may
+// also be formatted as [[HH:]MM:]SS or as a Go duration such as 1h30m.
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	if parts := strings.Split(value, ":"); len(parts) > 1 && len(parts) <= 3 {
+		total := time.Duration(0)
+		for _, part := range parts {
+			number, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("unknown duration format %q", value)
+			}
+			total = total*60 + time.Duration(number)*time.Second
+		}
+		return total, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unknown duration format %q", value)
+	}
+	return duration, nil
+}
@@ -0,0 +1,43 @@
+package collectors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	want := time.Date(2021, time.March, 5, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"2021/03/05", "2021-03-05", "2021/3/5", "03/05/21", "03/05/2021", "3/5/21", " 20210305 "} {
+		date, err := parseDate(value)
+		if err != nil || !date.Equal(want) {
+			t.Errorf("%q: want %s, have %s, %v", value, want, date, err)
+		}
+	}
+
+	for _, value := range []string{"", "unknown", "2021/13/01", "05.03.2021"} {
+		if _, err := parseDate(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"1800":     30 * time.Minute,
+		"2.5":      2500 * time.Millisecond,
+		"05:30":    5*time.Minute + 30*time.Second,
+		"01:02:03": time.Hour + 2*time.Minute + 3*time.Second,
+		"1h30m":    90 * time.Minute,
+	} {
+		duration, err := parseDuration(value)
+		if err != nil || duration != want {
+			t.Errorf("%q: want %s, have %s, %v", value, want, duration, err)
+		}
+	}
+
+	for _, value := range []string{"", "soon", "1:2:3:4", "1:-2"} {
+		if _, err := parseDuration(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
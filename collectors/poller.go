@@ -0,0 +1,148 @@
+package collectors
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poller reads the NUT server in the background for a collector in polling mode
+type poller struct {
+	interval time.Duration
+	maxAge   time.Duration
+
+	mu sync.Mutex
+	// snapshot holds the metrics of the last successful poll except up, which follows the latest
+	// poll so that a NUT server that can not be read is not reported as healthy
+	snapshot []prometheus.Metric
+	taken    time.Time
+	up       bool
+
+	// ready is closed once the first poll completed
+	ready     chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+	cancelCtx context.Context
+	cancel    context.CancelFunc
+}
+
+func (c *NutCollector) startPolling() {
+	maxAge := c.opts.PollMaxAge
+	if maxAge <= 0 {
+		maxAge = 3 * c.opts.PollInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.poller = &poller{
+		interval:  c.opts.PollInterval,
+		maxAge:    maxAge,
+		ready:     make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		cancelCtx: ctx,
+		cancel:    cancel,
+	}
+	c.ageDesc = prometheus.NewDesc(prometheus.BuildFQName(c.opts.Namespace, "", "snapshot_age_seconds"),
+		"Age of the snapshot of the NUT server served by this scrape in polling mode",
+		nil, nil,
+	)
+	go c.poll()
+}
+
+// poll refreshes the snapshot every interval until the collector is closed
+func (c *NutCollector) poll() {
+	defer close(c.poller.done)
+	ticker := time.NewTicker(c.poller.interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		c.refresh()
+		if first {
+			close(c.poller.ready)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.poller.stop:
+			return
+		}
+	}
+}
+
+// refresh reads the NUT server and replaces the snapshot if the read succeeded. Failed reads are
+// only counted, so the previous snapshot ages until it is replaced or too old to be served.
+func (c *NutCollector) refresh() {
+	ctx, cancel := context.WithTimeout(c.poller.cancelCtx, c.poller.interval)
+	defer cancel()
+
+	ch := make(chan prometheus.Metric)
+	metrics := []prometheus.Metric{}
+	collected := make(chan struct{})
+	go func() {
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		close(collected)
+	}()
+	ok := c.collectNUT(ctx, ch)
+	close(ch)
+	<-collected
+
+	c.poller.mu.Lock()
+	defer c.poller.mu.Unlock()
+	c.poller.up = ok
+	if !ok {
+		c.logger.Warn("Polling the NUT server failed, keeping the previous snapshot", "server", c.opts.Server)
+		return
+	}
+	c.poller.snapshot = slices.DeleteFunc(metrics, func(metric prometheus.Metric) bool {
+		return metric.Desc() == c.upDesc
+	})
+	c.poller.taken = time.Now()
+}
+
+// collectSnapshot sends the latest snapshot along with up from the latest poll. Before the first
+// poll completed, the scrape waits for it as long as ctx allows. Without a snapshot that is recent
+// enough, only up is sent, set to 0.
+func (c *NutCollector) collectSnapshot(ctx context.Context, ch chan<- prometheus.Metric) {
+	select {
+	case <-c.poller.ready:
+	case <-ctx.Done():
+	}
+
+	c.poller.mu.Lock()
+	snapshot, taken, up := c.poller.snapshot, c.poller.taken, c.poller.up
+	c.poller.mu.Unlock()
+
+	if snapshot != nil {
+		age := time.Since(taken)
+		ch <- prometheus.MustNewConstMetric(c.ageDesc, prometheus.GaugeValue, age.Seconds())
+		if age <= c.poller.maxAge {
+			for _, metric := range snapshot {
+				ch <- metric
+			}
+			value := float64(0)
+			if up {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, value)
+			return
+		}
+		c.logger.Warn("Snapshot of the NUT server is too old to be served", "server", c.opts.Server, "age", age, "max_age", c.poller.maxAge)
+	}
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 0)
+}
+
+// Close stops polling. It must be called when a collector in polling mode is no longer used.
+func (c *NutCollector) Close() {
+	if c.poller == nil {
+		return
+	}
+	c.poller.stopOnce.Do(func() {
+		close(c.poller.stop)
+		c.poller.cancel()
+	})
+	<-c.poller.done
+}
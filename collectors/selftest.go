@@ -0,0 +1,318 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+// Types of battery tests
+const (
+	BatteryTestQuick = "quick"
+	BatteryTestDeep  = "deep"
+)
+
+// BatteryTestTypes lists the valid types of battery tests
+var BatteryTestTypes = []string{BatteryTestQuick, BatteryTestDeep}
+
+var (
+	// Instant command starting each type of battery test
+	batteryTestCommands = map[string]string{
+		BatteryTestQuick: "test.battery.start.quick",
+		BatteryTestDeep:  "test.battery.start.deep",
+	}
+	// Time allowed for each type of battery test to report a result by default
+	batteryTestTimeouts = map[string]time.Duration{
+		BatteryTestQuick: 10 * time.Minute,
+		BatteryTestDeep:  3 * time.Hour,
+	}
+	// How often ups.test.result is read while a test runs
+	batteryTestPollInterval = 2 * time.Second
+
+	// Values of ups.test.result while a test has not finished
+	batteryTestRunningRegex = regexp.MustCompile(`(?i)progress|scheduled|running|pending`)
+	// Values of ups.test.result of a passed test
+	batteryTestPassedRegex = regexp.MustCompile(`(?i)passed|^(done|ok)$`)
+)
+
+// BatteryTest is a battery test run on a schedule
+type BatteryTest struct {
+	// Opts select the NUT server and the UPS. The user needs instcmds permissions.
+	Opts NutCollectorOpts
+	// Schedule is a cron expression with five fields or a descriptor such as @weekly
+	Schedule string
+	// Type is one of BatteryTestTypes and defaults to BatteryTestQuick
+	Type string
+	// Timeout is the time allowed for the test to report a result. Zero uses the default of the type.
+	Timeout time.Duration
+}
+
+// BatteryTestResult is the outcome of a battery test
+type BatteryTestResult struct {
+	Time   time.Time
+	Result string
+	Passed bool
+}
+
+// ParseSchedule checks a cron expression of a battery test
+func ParseSchedule(schedule string) error {
+	_, err := cron.ParseStandard(schedule)
+	return err
+}
+
+// RunBatteryTest starts a battery test on the UPS of the options and waits until ups.test.result
+// reports its outcome or ctx is done. The session is only held while talking to NUT so that
+// scrapes continue while the test runs.
+func RunBatteryTest(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger, testType string) (BatteryTestResult, error) {
+	result := BatteryTestResult{}
+	command, ok := batteryTestCommands[testType]
+	if !ok {
+		return result, fmt.Errorf("invalid battery test type %q", testType)
+	}
+
+	before, err := readVariable(ctx, opts, logger, "ups.test.result")
+	if err != nil {
+		return result, fmt.Errorf("failure reading ups.test.result: %w", err)
+	}
+
+	started, err := RunCommand(ctx, opts, logger, opts.Ups, command, "")
+	if err != nil {
+		return result, fmt.Errorf("failure starting the battery test: %w", err)
+	}
+	switch started.Status {
+	case nutclient.TrackingSuccess, nutclient.TrackingPending, TrackingUnsupported:
+	default:
+		return result, fmt.Errorf("the driver failed to start the battery test: %s", started.Status)
+	}
+	logger.Info("Started battery test", "server", opts.Server, "ups", opts.Ups, "command", command, "previous_result", before)
+
+	//A new result is either different from the previous one or follows a running test
+	running := false
+	ticker := time.NewTicker(batteryTestPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return result, fmt.Errorf("ups.test.result did not report a result in time: %w", ctx.Err())
+		}
+
+		value, err := readVariable(ctx, opts, logger, "ups.test.result")
+		if err != nil {
+			logger.Debug("Failure reading the battery test result, retrying", "ups", opts.Ups, "err", err)
+			continue
+		}
+		if batteryTestRunningRegex.MatchString(value) {
+			running = true
+			continue
+		}
+		if value == before && !running {
+			continue
+		}
+
+		result.Time = time.Now()
+		result.Result = value
+		result.Passed = batteryTestPassedRegex.MatchString(value)
+		return result, nil
+	}
+}
+
+// readVariable reads one variable of the UPS of the options on the shared session
+func readVariable(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger, variable string) (string, error) {
+	conn := connections.get(&opts, logger)
+	client, err := conn.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.release()
+
+	value, err := client.GetVariable(ctx, opts.Ups, variable)
+	if err != nil {
+		conn.fail(err)
+	}
+	return value, err
+}
+
+// BatteryTestScheduler runs battery tests on their schedules and keeps the last result of each
+type BatteryTestScheduler struct {
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	cron      *cron.Cron
+	scheduled map[string]bool
+	results   map[string]BatteryTestResult
+	running   map[string]bool
+	// attempts holds the time the last test of each target completed or failed to
+	attempts map[string]time.Time
+	// errors counts the tests of each target that failed to complete
+	errors map[string]int
+}
+
+func NewBatteryTestScheduler(logger *slog.Logger) *BatteryTestScheduler {
+	return &BatteryTestScheduler{
+		logger:    logger,
+		scheduled: make(map[string]bool),
+		results:   make(map[string]BatteryTestResult),
+		running:   make(map[string]bool),
+		attempts:  make(map[string]time.Time),
+		errors:    make(map[string]int),
+	}
+}
+
+// Update replaces the scheduled tests. Tests are keyed by the name of their target. Tests that are
+// running continue and the results of earlier tests are kept.
+func (s *BatteryTestScheduler) Update(tests map[string]BatteryTest) error {
+	scheduler := cron.New()
+	for name, test := range tests {
+		if test.Type == "" {
+			test.Type = BatteryTestQuick
+		}
+		if test.Timeout == 0 {
+			test.Timeout = batteryTestTimeouts[test.Type]
+		}
+		if _, err := scheduler.AddFunc(test.Schedule, func() { s.run(name, test) }); err != nil {
+			return fmt.Errorf("invalid schedule %q of the battery test of %s: %w", test.Schedule, name, err)
+		}
+		s.logger.Info("Scheduled battery test", "target", name, "ups", test.Opts.Ups, "type", test.Type, "schedule", test.Schedule)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cron != nil {
+		s.cron.Stop()
+	}
+	s.scheduled = make(map[string]bool)
+	for name := range tests {
+		s.scheduled[name] = true
+	}
+	s.cron = scheduler
+	s.cron.Start()
+	return nil
+}
+
+// Stop stops scheduling tests. Tests that are running continue.
+func (s *BatteryTestScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cron != nil {
+		s.cron.Stop()
+		s.cron = nil
+	}
+}
+
+func (s *BatteryTestScheduler) run(name string, test BatteryTest) {
+	s.mu.Lock()
+	if s.running[name] {
+		s.mu.Unlock()
+		s.logger.Warn("Skipping battery test, the previous test is still running", "target", name, "ups", test.Opts.Ups)
+		return
+	}
+	s.running[name] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, name)
+		s.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), test.Timeout)
+	defer cancel()
+	result, err := RunBatteryTest(ctx, test.Opts, s.logger, test.Type)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts[name] = time.Now()
+	if err != nil {
+		s.logger.Error("Battery test failed to complete", "target", name, "ups", test.Opts.Ups, "type", test.Type, "err", err)
+		s.errors[name]++
+		return
+	}
+	s.logger.Info("Battery test completed", "target", name, "ups", test.Opts.Ups, "type", test.Type, "result", result.Result, "passed", result.Passed)
+	s.results[name] = result
+}
+
+// Collector returns a collector exporting the last battery test result of the target, if any
+func (s *BatteryTestScheduler) Collector(name string, opts NutCollectorOpts) prometheus.Collector {
+	//Identity labels are read from the UPS during scrapes and are not known here
+	upsLabels := []string{}
+	upsLabelValues := []string{}
+	if opts.MultiUps {
+		upsLabels = []string{"ups"}
+		upsLabelValues = []string{opts.Ups}
+	}
+
+	return &batteryTestCollector{
+		scheduler:      s,
+		name:           name,
+		upsLabelValues: upsLabelValues,
+		timestampDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "last_battery_test_timestamp_seconds"),
+			"Time the last battery test run by the exporter reported its result",
+			upsLabels, nil,
+		),
+		resultDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "last_battery_test_result"),
+			"Whether the last battery test run by the exporter passed, with the value of ups.test.result",
+			append(upsLabels, "result"), nil,
+		),
+		attemptDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "last_battery_test_attempt_timestamp_seconds"),
+			"Time the last battery test run by the exporter completed or failed to complete",
+			upsLabels, nil,
+		),
+		errorsDesc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", "battery_test_errors_total"),
+			"Battery tests run by the exporter that could not be started, were rejected by the driver or did not report a result in time",
+			upsLabels, nil,
+		),
+	}
+}
+
+type batteryTestCollector struct {
+	scheduler      *BatteryTestScheduler
+	name           string
+	upsLabelValues []string
+	timestampDesc  *prometheus.Desc
+	resultDesc     *prometheus.Desc
+	attemptDesc    *prometheus.Desc
+	errorsDesc     *prometheus.Desc
+}
+
+func (c *batteryTestCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.timestampDesc
+	ch <- c.resultDesc
+	ch <- c.attemptDesc
+	ch <- c.errorsDesc
+}
+
+func (c *batteryTestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.scheduler.mu.Lock()
+	result, ok := c.scheduler.results[c.name]
+	attempt, attempted := c.scheduler.attempts[c.name]
+	errors, scheduled := c.scheduler.errors[c.name], c.scheduler.scheduled[c.name]
+	c.scheduler.mu.Unlock()
+
+	//The error counter starts at 0 so that increases can be alerted on
+	if scheduled || errors > 0 {
+		ch <- prometheus.MustNewConstMetric(c.errorsDesc, prometheus.CounterValue, float64(errors), c.upsLabelValues...)
+	}
+	if attempted {
+		ch <- prometheus.MustNewConstMetric(c.attemptDesc, prometheus.GaugeValue, float64(attempt.Unix()), c.upsLabelValues...)
+	}
+	if !ok {
+		return
+	}
+
+	passed := float64(0)
+	if result.Passed {
+		passed = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.timestampDesc, prometheus.GaugeValue, float64(result.Time.Unix()), c.upsLabelValues...)
+	ch <- prometheus.MustNewConstMetric(c.resultDesc, prometheus.GaugeValue, passed, append(c.upsLabelValues, strings.TrimSpace(result.Result))...)
+}
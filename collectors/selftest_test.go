@@ -0,0 +1,37 @@
+package collectors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatteryTestErrors(t *testing.T) {
+	server := newTestUpsd(t)
+	server.set("GET VAR rack1 ups.test.result", `VAR rack1 ups.test.result "No test initiated"`)
+	server.set("INSTCMD rack1 test.battery.start.quick", "ERR CMD-NOT-SUPPORTED")
+	opts := testOpts(server)
+	opts.Ups = "rack1"
+
+	scheduler := NewBatteryTestScheduler(testLogger)
+	defer scheduler.Stop()
+	test := BatteryTest{Opts: opts, Schedule: "@yearly", Type: BatteryTestQuick, Timeout: time.Second}
+	if err := scheduler.Update(map[string]BatteryTest{"rack1": test}); err != nil {
+		t.Fatal(err)
+	}
+	collector := scheduler.Collector("rack1", opts)
+
+	expectSeries(t, scrape(t, collector), map[string]float64{
+		"network_ups_tools_battery_test_errors_total":                   0,
+		"network_ups_tools_last_battery_test_attempt_timestamp_seconds": -1,
+	})
+
+	scheduler.run("rack1", test)
+	series := scrape(t, collector)
+	expectSeries(t, series, map[string]float64{
+		"network_ups_tools_battery_test_errors_total":           1,
+		"network_ups_tools_last_battery_test_timestamp_seconds": -1,
+	})
+	if attempt := series["network_ups_tools_last_battery_test_attempt_timestamp_seconds"]; time.Since(time.Unix(int64(attempt), 0)) > time.Minute {
+		t.Errorf("unexpected attempt timestamp %v", attempt)
+	}
+}
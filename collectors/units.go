@@ -0,0 +1,77 @@
+package collectors
+
+// Values of NutCollectorOpts.MetricNaming
+const (
+	// MetricNamingLegacy names metrics after the NUT variable only
+	MetricNamingLegacy = "legacy"
+	// MetricNamingConventional names known variables with a unit suffix and converts percentages
+	// to ratios
+	MetricNamingConventional = "conventional"
+	// MetricNamingBoth exports known variables with both names
+	MetricNamingBoth = "both"
+)
+
+// MetricNamings lists the valid values of NutCollectorOpts.MetricNaming
+var MetricNamings = []string{MetricNamingLegacy, MetricNamingConventional, MetricNamingBoth}
+
+// conventionalMetric describes how a known NUT variable is exported with conventional naming
+type conventionalMetric struct {
+	name  string
+	help  string
+	scale float64
+}
+
+// DefaultCounterVariables are the patterns of variables known to only ever increase
+var DefaultCounterVariables = []string{"battery.charger.cycles", "*.count", "*.counter"}
+
+// Percentages are scaled to ratios
+const percent = 0.01
+
+// conventionalMetrics holds the NUT variables with a known unit, from the NUT variable
+// documentation (docs/nut-names.txt)
+var conventionalMetrics = map[string]conventionalMetric{
+	"ambient.humidity":         {"ambient_humidity_ratio", "Ambient relative humidity", percent},
+	"ambient.temperature":      {"ambient_temperature_celsius", "Ambient temperature", 1},
+	"battery.charge":           {"battery_charge_ratio", "Battery charge as a ratio of full", percent},
+	"battery.charge.low":       {"battery_charge_low_ratio", "Remaining battery charge ratio for a low battery condition", percent},
+	"battery.charge.restart":   {"battery_charge_restart_ratio", "Minimum battery charge ratio for restarting the UPS after a shutdown", percent},
+	"battery.charge.warning":   {"battery_charge_warning_ratio", "Battery charge ratio for a warning condition", percent},
+	"battery.current":          {"battery_current_amperes", "Battery current", 1},
+	"battery.runtime":          {"battery_runtime_seconds", "Remaining battery runtime", 1},
+	"battery.runtime.low":      {"battery_runtime_low_seconds", "Remaining battery runtime for a low battery condition", 1},
+	"battery.temperature":      {"battery_temperature_celsius", "Battery temperature", 1},
+	"battery.voltage":          {"battery_voltage_volts", "Battery voltage", 1},
+	"battery.voltage.nominal":  {"battery_voltage_nominal_volts", "Nominal battery voltage", 1},
+	"input.current":            {"input_current_amperes", "Input current", 1},
+	"input.current.nominal":    {"input_current_nominal_amperes", "Nominal input current", 1},
+	"input.frequency":          {"input_frequency_hertz", "Input line frequency", 1},
+	"input.frequency.nominal":  {"input_frequency_nominal_hertz", "Nominal input line frequency", 1},
+	"input.realpower":          {"input_realpower_watts", "Input real power", 1},
+	"input.transfer.high":      {"input_transfer_high_volts", "High voltage transfer point", 1},
+	"input.transfer.low":       {"input_transfer_low_volts", "Low voltage transfer point", 1},
+	"input.voltage":            {"input_voltage_volts", "Input voltage", 1},
+	"input.voltage.maximum":    {"input_voltage_maximum_volts", "Maximum input voltage seen", 1},
+	"input.voltage.minimum":    {"input_voltage_minimum_volts", "Minimum input voltage seen", 1},
+	"input.voltage.nominal":    {"input_voltage_nominal_volts", "Nominal input voltage", 1},
+	"output.current":           {"output_current_amperes", "Output current", 1},
+	"output.current.nominal":   {"output_current_nominal_amperes", "Nominal output current", 1},
+	"output.frequency":         {"output_frequency_hertz", "Output frequency", 1},
+	"output.frequency.nominal": {"output_frequency_nominal_hertz", "Nominal output frequency", 1},
+	"output.power":             {"output_power_voltamperes", "Output apparent power", 1},
+	"output.realpower":         {"output_realpower_watts", "Output real power", 1},
+	"output.voltage":           {"output_voltage_volts", "Output voltage", 1},
+	"output.voltage.nominal":   {"output_voltage_nominal_volts", "Nominal output voltage", 1},
+	"ups.delay.reboot":         {"ups_delay_reboot_seconds", "Interval to wait before rebooting the UPS", 1},
+	"ups.delay.shutdown":       {"ups_delay_shutdown_seconds", "Interval to wait after a shutdown command before shutting down the load", 1},
+	"ups.delay.start":          {"ups_delay_start_seconds", "Interval to wait before restarting the load", 1},
+	"ups.efficiency":           {"ups_efficiency_ratio", "Efficiency of the UPS as a ratio of output to input power", percent},
+	"ups.load":                 {"ups_load_ratio", "Load on the UPS as a ratio of its capacity", percent},
+	"ups.power":                {"ups_power_voltamperes", "Current apparent power drawn from the UPS", 1},
+	"ups.power.nominal":        {"ups_power_nominal_voltamperes", "Nominal apparent power of the UPS", 1},
+	"ups.realpower":            {"ups_realpower_watts", "Current real power drawn from the UPS", 1},
+	"ups.realpower.nominal":    {"ups_realpower_nominal_watts", "Nominal real power of the UPS", 1},
+	"ups.temperature":          {"ups_temperature_celsius", "UPS temperature", 1},
+	"ups.timer.reboot":         {"ups_timer_reboot_seconds", "Time before the load is rebooted", 1},
+	"ups.timer.shutdown":       {"ups_timer_shutdown_seconds", "Time before the load is shut down", 1},
+	"ups.timer.start":          {"ups_timer_start_seconds", "Time before the load is started", 1},
+}
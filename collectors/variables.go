@@ -0,0 +1,152 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+// WritableVariable is a writable variable of a UPS with the constraints on its value
+type WritableVariable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Types holds the flags of the variable, such as NUMBER, STRING, ENUM or RANGE
+	Types []string `json:"types"`
+	// MaxLength is the maximum length of STRING variables
+	MaxLength int          `json:"max_length,omitempty"`
+	Ranges    []ValueRange `json:"ranges,omitempty"`
+	Enum      []string     `json:"enum,omitempty"`
+
+	writable bool
+}
+
+// ValueRange is a range of values accepted by a RANGE variable
+type ValueRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// ListWritable returns the writable variables of the UPS with the constraints on their values
+func ListWritable(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger, ups string) ([]WritableVariable, error) {
+	conn := connections.get(&opts, logger)
+	client, err := conn.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+
+	variables, err := client.ListWritable(ctx, ups)
+	if err != nil {
+		conn.fail(err)
+		return nil, err
+	}
+
+	result := make([]WritableVariable, 0, len(variables))
+	for _, variable := range variables {
+		writable, err := describeWritable(ctx, client, ups, variable.Name, variable.Value)
+		if err != nil {
+			conn.fail(err)
+			return nil, err
+		}
+		result = append(result, writable)
+	}
+	return result, nil
+}
+
+// SetVariable sets a writable variable of the UPS with the credentials of the options and waits
+// for the result until ctx is done. The value is checked against the constraints reported by the
+// NUT server first. Values that do not satisfy them are rejected with the *nutclient.Error upsd
+// would return, without being sent. The variable as it was before the change is returned.
+func SetVariable(ctx context.Context, opts NutCollectorOpts, logger *slog.Logger, ups string, variable string, value string) (WritableVariable, TrackedResult, error) {
+	previous := WritableVariable{Name: variable}
+	result, err := runTracked(ctx, opts, logger, func(client *nutclient.Client) (string, error) {
+		current, err := client.GetVariable(ctx, ups, variable)
+		if err != nil {
+			return "", err
+		}
+		previous, err = describeWritable(ctx, client, ups, variable, current)
+		if err != nil {
+			return "", err
+		}
+		if err := previous.validate(value); err != nil {
+			return "", err
+		}
+		return client.SetVariable(ctx, ups, variable, value)
+	})
+	return previous, result, err
+}
+
+// describeWritable looks up the type and constraints of a variable
+func describeWritable(ctx context.Context, client *nutclient.Client, ups string, name string, value string) (WritableVariable, error) {
+	result := WritableVariable{Name: name, Value: value}
+
+	variableType, err := client.GetType(ctx, ups, name)
+	if err != nil {
+		return result, err
+	}
+	result.writable = variableType.Writable
+	result.Types = variableType.Types
+	result.MaxLength = variableType.MaxLength
+
+	if slices.Contains(result.Types, "ENUM") {
+		result.Enum, err = client.ListEnum(ctx, ups, name)
+		if err != nil {
+			return result, err
+		}
+	}
+	if slices.Contains(result.Types, "RANGE") {
+		ranges, err := client.ListRange(ctx, ups, name)
+		if err != nil {
+			return result, err
+		}
+		for _, r := range ranges {
+			result.Ranges = append(result.Ranges, ValueRange{Min: r.Min, Max: r.Max})
+		}
+	}
+	return result, nil
+}
+
+// validate checks a new value against the constraints of the variable
+func (v WritableVariable) validate(value string) error {
+	if !v.writable {
+		return &nutclient.Error{Code: "READONLY"}
+	}
+	if v.MaxLength > 0 && len(value) > v.MaxLength {
+		return &nutclient.Error{Code: "TOO-LONG", Extra: fmt.Sprintf("at most %d characters", v.MaxLength)}
+	}
+	if len(v.Enum) > 0 && !slices.Contains(v.Enum, value) {
+		return &nutclient.Error{Code: "INVALID-VALUE", Extra: fmt.Sprintf("not one of %q", v.Enum)}
+	}
+
+	if !slices.Contains(v.Types, "NUMBER") && len(v.Ranges) == 0 {
+		return nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return &nutclient.Error{Code: "INVALID-VALUE", Extra: "not a number"}
+	}
+	if len(v.Ranges) == 0 {
+		return nil
+	}
+	for _, r := range v.Ranges {
+		if number >= r.Min && number <= r.Max {
+			return nil
+		}
+	}
+	return &nutclient.Error{Code: "INVALID-VALUE", Extra: fmt.Sprintf("not within %s", v.rangeList())}
+}
+
+func (v WritableVariable) rangeList() string {
+	list := ""
+	for i, r := range v.Ranges {
+		if i > 0 {
+			list += ", "
+		}
+		list += strconv.FormatFloat(r.Min, 'f', -1, 64) + ".." + strconv.FormatFloat(r.Max, 'f', -1, 64)
+	}
+	return list
+}
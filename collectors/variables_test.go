@@ -0,0 +1,42 @@
+package collectors
+
+import (
+	"testing"
+
+	"github.com/DRuggeri/nut_exporter/v3/nutclient"
+)
+
+func TestValidateWritable(t *testing.T) {
+	number := WritableVariable{Name: "battery.charge.low", Types: []string{"NUMBER"}, writable: true}
+	ranged := WritableVariable{Name: "input.transfer.high", Types: []string{"NUMBER", "RANGE"}, Ranges: []ValueRange{{250, 260}, {270, 280}}, writable: true}
+	enum := WritableVariable{Name: "input.sensitivity", Types: []string{"ENUM"}, Enum: []string{"low", "normal", "high"}, writable: true}
+	str := WritableVariable{Name: "ups.id", Types: []string{"STRING"}, MaxLength: 4, writable: true}
+	readonly := WritableVariable{Name: "input.voltage", Types: []string{"NUMBER"}}
+
+	for _, test := range []struct {
+		variable WritableVariable
+		value    string
+		code     string
+	}{
+		{number, "10", ""},
+		{number, "1.5", ""},
+		{number, "ten", "INVALID-VALUE"},
+		{ranged, "250", ""},
+		{ranged, "275", ""},
+		{ranged, "265", "INVALID-VALUE"},
+		{ranged, "300", "INVALID-VALUE"},
+		{enum, "high", ""},
+		{enum, "max", "INVALID-VALUE"},
+		{str, "ab c", ""},
+		{str, "abcde", "TOO-LONG"},
+		{readonly, "230", "READONLY"},
+	} {
+		err := test.variable.validate(test.value)
+		if test.code == "" && err != nil {
+			t.Errorf("%s=%q: unexpected error %v", test.variable.Name, test.value, err)
+		}
+		if test.code != "" && !nutclient.IsErrorCode(err, test.code) {
+			t.Errorf("%s=%q: want %s, have %v", test.variable.Name, test.value, test.code, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Package config loads the optional configuration file of nut_exporter.
+//
+// The file is YAML (and therefore also accepts JSON) and defines named
+// targets. A scrape may reference a target with the `target` query string
+// parameter so that the NUT server, credentials and collector settings are
+// resolved by the exporter instead of being passed by Prometheus.
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+// Config is the top level structure of the configuration file
+type Config struct {
+	Targets map[string]Target `yaml:"targets"`
+	// Mappings apply to all scrapes. Targets may replace the mappings of individual variables.
+	Mappings map[string][]collectors.ValueMapping `yaml:"mappings"`
+}
+
+// Target holds the settings of a named target. Fields that are not set in the
+// file inherit the value of the corresponding command line flag.
+type Target struct {
+	Server            string   `yaml:"server"`
+	Port              int      `yaml:"port"`
+	Ups               string   `yaml:"ups"`
+	Username          string   `yaml:"username"`
+	Password          string   `yaml:"password"`
+	Variables         []string `yaml:"variables"`
+	Statuses          []string `yaml:"statuses"`
+	OnRegex           *string  `yaml:"on_regex"`
+	OffRegex          *string  `yaml:"off_regex"`
+	Namespace         string   `yaml:"namespace"`
+	DisableDeviceInfo *bool    `yaml:"disable_device_info"`
+	MultiUps          *bool    `yaml:"multi_ups"`
+	DeviceLabels      []string `yaml:"device_labels"`
+	IdentityLabels    []string `yaml:"identity_labels"`
+	Inventory         *bool    `yaml:"inventory"`
+	Clients           *bool    `yaml:"clients"`
+	VariableOutput    string   `yaml:"variable_output"`
+	MetricNaming      string   `yaml:"metric_naming"`
+	CounterVariables  []string `yaml:"counter_variables"`
+	StringVariables   []string `yaml:"string_variables"`
+	StringMaxLength   *int     `yaml:"string_max_length"`
+	StringMaxSeries   *int     `yaml:"string_max_series"`
+	DateVariables     []string `yaml:"date_variables"`
+	DurationVariables []string `yaml:"duration_variables"`
+	// PollInterval and PollMaxAge are durations such as 30s
+	PollInterval string `yaml:"poll_interval"`
+	PollMaxAge   string `yaml:"poll_max_age"`
+
+	Mappings map[string][]collectors.ValueMapping `yaml:"mappings"`
+
+	TLS                   *bool  `yaml:"tls"`
+	TLSRequired           *bool  `yaml:"tls_required"`
+	TLSCAFile             string `yaml:"tls_ca_file"`
+	TLSCertFile           string `yaml:"tls_cert_file"`
+	TLSKeyFile            string `yaml:"tls_key_file"`
+	TLSServerName         string `yaml:"tls_server_name"`
+	TLSInsecureSkipVerify *bool  `yaml:"tls_insecure_skip_verify"`
+
+	BatteryTest *BatteryTest `yaml:"battery_test"`
+}
+
+// BatteryTest schedules battery tests of the UPS of a target
+type BatteryTest struct {
+	// Schedule is a cron expression such as "0 3 * * 0" or a descriptor such as @weekly
+	Schedule string `yaml:"schedule"`
+	// Type is quick or deep
+	Type string `yaml:"type"`
+	// Timeout is the time allowed for the test to report a result, such as 10m
+	Timeout string `yaml:"timeout"`
+}
+
+// TimeoutDuration returns the parsed timeout of the test, or 0 if none was set
+func (b BatteryTest) TimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(b.Timeout)
+	return timeout
+}
+
+// Load reads and validates the configuration file at the given path
+func Load(filename string) (*Config, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating %s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for errors that would otherwise only be
+// detected when a target is scraped
+func (c *Config) Validate() error {
+	if err := validateMappings(c.Mappings); err != nil {
+		return err
+	}
+	for name, target := range c.Targets {
+		if name == "" {
+			return fmt.Errorf("targets must have a name")
+		}
+		if target.Port < 0 || target.Port > 65535 {
+			return fmt.Errorf("target %s: invalid port %d", name, target.Port)
+		}
+		if target.Password != "" && target.Username == "" {
+			return fmt.Errorf("target %s: password requires username to be set", name)
+		}
+		if (target.TLSCertFile == "") != (target.TLSKeyFile == "") {
+			return fmt.Errorf("target %s: tls_cert_file and tls_key_file must be set together", name)
+		}
+		for _, limit := range []*int{target.StringMaxLength, target.StringMaxSeries} {
+			if limit != nil && *limit < 0 {
+				return fmt.Errorf("target %s: string limits must not be negative", name)
+			}
+		}
+		if err := validateMappings(target.Mappings); err != nil {
+			return fmt.Errorf("target %s: %w", name, err)
+		}
+		if target.VariableOutput != "" && !slices.Contains(collectors.VariableOutputs, target.VariableOutput) {
+			return fmt.Errorf("target %s: invalid variable_output %q", name, target.VariableOutput)
+		}
+		if target.MetricNaming != "" && !slices.Contains(collectors.MetricNamings, target.MetricNaming) {
+			return fmt.Errorf("target %s: invalid metric_naming %q", name, target.MetricNaming)
+		}
+		for _, pattern := range target.CounterVariables {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("target %s: invalid counter variable pattern %q", name, pattern)
+			}
+		}
+		if target.DeviceLabels != nil {
+			if err := collectors.ValidateDeviceLabels(target.DeviceLabels, target.IdentityLabels); err != nil {
+				return fmt.Errorf("target %s: %w", name, err)
+			}
+		}
+		for _, duration := range []string{target.PollInterval, target.PollMaxAge} {
+			if duration == "" {
+				continue
+			}
+			if value, err := time.ParseDuration(duration); err != nil || value < 0 {
+				return fmt.Errorf("target %s: invalid poll duration %q", name, duration)
+			}
+		}
+		if target.BatteryTest != nil {
+			if err := target.BatteryTest.validate(target); err != nil {
+				return fmt.Errorf("target %s: %w", name, err)
+			}
+		}
+		for _, re := range []*string{target.OnRegex, target.OffRegex} {
+			if re == nil {
+				continue
+			}
+			if _, err := regexp.Compile(*re); err != nil {
+				return fmt.Errorf("target %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (b BatteryTest) validate(target Target) error {
+	if target.Ups == "" {
+		return fmt.Errorf("battery_test requires the ups of the target to be set")
+	}
+	if err := collectors.ParseSchedule(b.Schedule); err != nil {
+		return fmt.Errorf("invalid battery_test schedule %q: %w", b.Schedule, err)
+	}
+	if b.Type != "" && !slices.Contains(collectors.BatteryTestTypes, b.Type) {
+		return fmt.Errorf("invalid battery_test type %q", b.Type)
+	}
+	if b.Timeout != "" {
+		if timeout, err := time.ParseDuration(b.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid battery_test timeout %q", b.Timeout)
+		}
+	}
+	return nil
+}
+
+func validateMappings(mappings map[string][]collectors.ValueMapping) error {
+	for variable, variableMappings := range mappings {
+		for _, mapping := range variableMappings {
+			if err := mapping.Validate(); err != nil {
+				return fmt.Errorf("mapping of %s: %w", variable, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply returns a copy of opts with the settings of the target applied on top
+func (t Target) Apply(opts collectors.NutCollectorOpts) collectors.NutCollectorOpts {
+	if t.Server != "" {
+		opts.Server = t.Server
+	}
+	if t.Port != 0 {
+		opts.ServerPort = t.Port
+	}
+	if t.Ups != "" {
+		opts.Ups = t.Ups
+	}
+	if t.Username != "" {
+		opts.Username = t.Username
+		opts.Password = t.Password
+	}
+	if t.Variables != nil {
+		opts.Variables = t.Variables
+	}
+	if t.Statuses != nil {
+		opts.Statuses = t.Statuses
+	}
+	if t.OnRegex != nil {
+		opts.OnRegex = *t.OnRegex
+	}
+	if t.OffRegex != nil {
+		opts.OffRegex = *t.OffRegex
+	}
+	if t.Namespace != "" {
+		opts.Namespace = t.Namespace
+	}
+	if t.DisableDeviceInfo != nil {
+		opts.DisableDeviceInfo = *t.DisableDeviceInfo
+	}
+	if t.MultiUps != nil {
+		opts.MultiUps = *t.MultiUps
+	}
+	if t.DeviceLabels != nil {
+		opts.DeviceLabels = t.DeviceLabels
+	}
+	if t.IdentityLabels != nil {
+		opts.IdentityLabels = t.IdentityLabels
+	}
+	if t.Inventory != nil {
+		opts.Inventory = *t.Inventory
+	}
+	if t.Clients != nil {
+		opts.Clients = *t.Clients
+	}
+	if t.VariableOutput != "" {
+		opts.VariableOutput = t.VariableOutput
+	}
+	if t.MetricNaming != "" {
+		opts.MetricNaming = t.MetricNaming
+	}
+	if t.CounterVariables != nil {
+		opts.CounterVariables = t.CounterVariables
+	}
+	if t.StringVariables != nil {
+		opts.StringVariables = t.StringVariables
+	}
+	if t.StringMaxLength != nil {
+		opts.StringMaxLength = *t.StringMaxLength
+	}
+	if t.StringMaxSeries != nil {
+		opts.StringMaxSeries = *t.StringMaxSeries
+	}
+	if t.DateVariables != nil {
+		opts.DateVariables = t.DateVariables
+	}
+	if t.DurationVariables != nil {
+		opts.DurationVariables = t.DurationVariables
+	}
+	if t.PollInterval != "" {
+		opts.PollInterval, _ = time.ParseDuration(t.PollInterval)
+	}
+	if t.PollMaxAge != "" {
+		opts.PollMaxAge, _ = time.ParseDuration(t.PollMaxAge)
+	}
+	if t.Mappings != nil {
+		opts.Mappings = maps.Clone(opts.Mappings)
+		if opts.Mappings == nil {
+			opts.Mappings = make(map[string][]collectors.ValueMapping)
+		}
+		maps.Copy(opts.Mappings, t.Mappings)
+	}
+	if t.TLS != nil {
+		opts.TLS = *t.TLS
+	}
+	if t.TLSRequired != nil {
+		opts.TLSRequired = *t.TLSRequired
+	}
+	if t.TLSCAFile != "" {
+		opts.TLSCAFile = t.TLSCAFile
+	}
+	if t.TLSCertFile != "" {
+		opts.TLSCertFile = t.TLSCertFile
+		opts.TLSKeyFile = t.TLSKeyFile
+	}
+	if t.TLSServerName != "" {
+		opts.TLSServerName = t.TLSServerName
+	}
+	if t.TLSInsecureSkipVerify != nil {
+		opts.TLSInsecureSkipVerify = *t.TLSInsecureSkipVerify
+	}
+	return opts
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadAndApply(t *testing.T) {
+	filename := writeConfig(t, `
+targets:
+  dc1-rack3:
+    server: nut.example.com
+    port: 3494
+    username: monitor
+    password: secret
+    variables: []
+    off_regex: ""
+    multi_ups: true
+    inventory: true
+    device_labels: [model, location, ups.firmware]
+    identity_labels: [location]
+    clients: true
+    variable_output: both
+    metric_naming: conventional
+    string_variables: [battery.type]
+    string_max_series: 0
+    duration_variables: [ups.delay.shutdown]
+    poll_interval: 15s
+    ups: rack3
+    mappings:
+      ups.beeper.status:
+        - match: muted
+          value: 2
+    battery_test:
+      schedule: "0 3 * * 0"
+      type: deep
+      timeout: 2h
+mappings:
+  ups.test.result:
+    - match: Done and passed
+      value: 0
+    - regex: "^Done and warning"
+      value: 1
+  ups.beeper.status:
+    - match: enabled
+      value: 1
+`)
+
+	cfg, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, ok := cfg.Targets["dc1-rack3"]
+	if !ok {
+		t.Fatal("target dc1-rack3 not loaded")
+	}
+
+	base := collectors.NutCollectorOpts{
+		Namespace:  "network_ups_tools",
+		Server:     "127.0.0.1",
+		ServerPort: 3493,
+		Variables:  []string{"ups.status"},
+		Statuses:   []string{"OL"},
+		OnRegex:    "^on$",
+		OffRegex:   "^off$",
+
+		StringMaxLength: 64,
+		StringMaxSeries: 50,
+		DateVariables:   []string{"battery.date"},
+	}
+	opts := target.Apply(base)
+
+	if opts.Server != "nut.example.com" || opts.ServerPort != 3494 {
+		t.Errorf("unexpected server %s:%d", opts.Server, opts.ServerPort)
+	}
+	if opts.Username != "monitor" || opts.Password != "secret" {
+		t.Errorf("unexpected credentials %s/%s", opts.Username, opts.Password)
+	}
+	if opts.Variables == nil || len(opts.Variables) != 0 {
+		t.Errorf("expected an explicitly empty variable list, got %#v", opts.Variables)
+	}
+	if len(opts.Statuses) != 1 || opts.Statuses[0] != "OL" {
+		t.Errorf("statuses should be inherited, got %#v", opts.Statuses)
+	}
+	if opts.OnRegex != "^on$" || opts.OffRegex != "" {
+		t.Errorf("unexpected regexes %q/%q", opts.OnRegex, opts.OffRegex)
+	}
+	if !opts.MultiUps || !opts.Inventory || !opts.Clients {
+		t.Error("expected multi UPS mode, the inventory and client metrics to be enabled")
+	}
+	if len(opts.StringVariables) != 1 || opts.StringMaxLength != 64 || opts.StringMaxSeries != 0 {
+		t.Errorf("unexpected string settings %#v/%d/%d", opts.StringVariables, opts.StringMaxLength, opts.StringMaxSeries)
+	}
+	if len(opts.DurationVariables) != 1 || len(opts.DateVariables) != 1 {
+		t.Errorf("unexpected date and duration variables %#v/%#v", opts.DateVariables, opts.DurationVariables)
+	}
+	if len(cfg.Mappings["ups.test.result"]) != 2 || cfg.Mappings["ups.test.result"][1].Regex != "^Done and warning" {
+		t.Errorf("unexpected global mappings %#v", cfg.Mappings)
+	}
+	base.Mappings = cfg.Mappings
+	opts = target.Apply(base)
+	if len(opts.Mappings) != 2 || len(opts.Mappings["ups.test.result"]) != 2 || opts.Mappings["ups.beeper.status"][0].Match != "muted" {
+		t.Errorf("target mappings should replace global mappings per variable, got %#v", opts.Mappings)
+	}
+	if cfg.Mappings["ups.beeper.status"][0].Match != "enabled" {
+		t.Error("Apply modified the global mappings")
+	}
+	if opts.VariableOutput != collectors.VariableOutputBoth || opts.MetricNaming != collectors.MetricNamingConventional {
+		t.Errorf("unexpected variable output %q and naming %q", opts.VariableOutput, opts.MetricNaming)
+	}
+	if len(opts.DeviceLabels) != 3 || len(opts.IdentityLabels) != 1 {
+		t.Errorf("unexpected device labels %#v/%#v", opts.DeviceLabels, opts.IdentityLabels)
+	}
+	if opts.PollInterval != 15*time.Second || opts.PollMaxAge != 0 {
+		t.Errorf("unexpected polling settings %s/%s", opts.PollInterval, opts.PollMaxAge)
+	}
+	if target.BatteryTest == nil || target.BatteryTest.Type != collectors.BatteryTestDeep || target.BatteryTest.TimeoutDuration() != 2*time.Hour {
+		t.Errorf("unexpected battery test %#v", target.BatteryTest)
+	}
+	if base.Server != "127.0.0.1" {
+		t.Error("Apply modified the base options")
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	filename := writeConfig(t, `{"targets": {"garage": {"server": "10.0.0.5", "ups": "apc"}}}`)
+
+	cfg, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Targets["garage"].Ups != "apc" {
+		t.Errorf("unexpected target %#v", cfg.Targets["garage"])
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field": "targets:\n  foo:\n    srever: localhost\n",
+		"bad regex":     "targets:\n  foo:\n    on_regex: \"(\"\n",
+		"bad port":      "targets:\n  foo:\n    port: 70000\n",
+		"no username":   "targets:\n  foo:\n    password: secret\n",
+		"bad output":    "targets:\n  foo:\n    variable_output: all\n",
+		"bad counter":   "targets:\n  foo:\n    counter_variables: [\"[\"]\n",
+		"bad naming":    "targets:\n  foo:\n    metric_naming: modern\n",
+		"bad limit":     "targets:\n  foo:\n    string_max_length: -1\n",
+		"bad mapping":   "mappings:\n  ups.test.result:\n    - value: 1\n",
+		"mapping regex": "mappings:\n  ups.test.result:\n    - regex: \"(\"\n",
+		"bad label":     "targets:\n  foo:\n    device_labels: [model, \"1st\"]\n",
+		"bad identity":  "targets:\n  foo:\n    device_labels: [model]\n    identity_labels: [location]\n",
+		"bad interval":  "targets:\n  foo:\n    poll_interval: 30\n",
+		"bad max age":   "targets:\n  foo:\n    poll_max_age: -1m\n",
+		"test no ups":   "targets:\n  foo:\n    battery_test:\n      schedule: \"@weekly\"\n",
+		"test schedule": "targets:\n  foo:\n    ups: apc\n    battery_test:\n      schedule: \"0 3 * *\"\n",
+		"test type":     "targets:\n  foo:\n    ups: apc\n    battery_test:\n      schedule: \"@weekly\"\n      type: long\n",
+		"test timeout":  "targets:\n  foo:\n    ups: apc\n    battery_test:\n      schedule: \"@weekly\"\n      timeout: soon\n",
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	filename := writeConfig(t, `
+credentials:
+  - server: nut.example.com
+    username: monitor
+    password: server
+  - server: nut.example.com
+    port: 3494
+    username: monitor
+    password: port
+  - server: nut.example.com
+    ups: rack3
+    username: admin
+    password_file: `+passwordFile+`
+`)
+
+	creds, err := LoadCredentials(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		port     int
+		ups      string
+		password string
+	}{
+		{3493, "rack1", "server"},
+		{3494, "rack1", "port"},
+		{3494, "rack3", "from-file"},
+	} {
+		cred, ok := creds.Lookup("NUT.example.com", test.port, test.ups)
+		if !ok || cred.Password != test.password {
+			t.Errorf("%d/%s: want password %q, have %#v", test.port, test.ups, test.password, cred)
+		}
+	}
+	if _, ok := creds.Lookup("other.example.com", 3493, "rack1"); ok {
+		t.Error("unexpected credential for another server")
+	}
+
+	for name, content := range map[string]string{
+		"no server":     "credentials:\n  - username: monitor\n",
+		"both":          "credentials:\n  - server: a\n    username: b\n    password: c\n    password_file: d\n",
+		"missing file":  "credentials:\n  - server: a\n    username: b\n    password_file: /nonexistent\n",
+		"unknown field": "credentials:\n  - server: a\n    user: b\n",
+	} {
+		if _, err := LoadCredentials(writeConfig(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Credentials maps NUT servers and UPS devices to the user to log in as
+type Credentials struct {
+	Credentials []Credential `yaml:"credentials"`
+}
+
+// Credential is the user for a NUT server, optionally limited to one port or UPS
+type Credential struct {
+	Server   string `yaml:"server"`
+	Port     int    `yaml:"port"`
+	Ups      string `yaml:"ups"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile is read instead of setting Password, such as a Docker or Kubernetes secret
+	PasswordFile string `yaml:"password_file"`
+}
+
+// LoadCredentials reads and validates the credentials file at the given path along with the
+// password files it references
+func LoadCredentials(filename string) (*Credentials, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+	if err := yaml.UnmarshalStrict(content, creds); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+
+	for i, cred := range creds.Credentials {
+		if cred.Server == "" || cred.Username == "" {
+			return nil, fmt.Errorf("error validating %s: credential %d: server and username must be set", filename, i+1)
+		}
+		if cred.Port < 0 || cred.Port > 65535 {
+			return nil, fmt.Errorf("error validating %s: credential %d: invalid port %d", filename, i+1, cred.Port)
+		}
+		if cred.Password != "" && cred.PasswordFile != "" {
+			return nil, fmt.Errorf("error validating %s: credential %d: only one of password and password_file may be set", filename, i+1)
+		}
+		if cred.PasswordFile != "" {
+			creds.Credentials[i].Password, err = ReadPasswordFile(cred.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("error validating %s: credential %d: %w", filename, i+1, err)
+			}
+		}
+	}
+	return creds, nil
+}
+
+// ReadPasswordFile reads a file holding a password. A trailing newline is not part of the password.
+func ReadPasswordFile(filename string) (string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Files returns the password files referenced by the credentials
+func (c *Credentials) Files() []string {
+	files := []string{}
+	for _, cred := range c.Credentials {
+		if cred.PasswordFile != "" {
+			files = append(files, cred.PasswordFile)
+		}
+	}
+	return files
+}
+
+// Lookup returns the most specific credential matching the server, port and UPS. A credential
+// for a UPS takes precedence over one for a port, which takes precedence over one for the whole
+// server. Among equally specific credentials, the first one wins.
+func (c *Credentials) Lookup(server string, port int, ups string) (Credential, bool) {
+	best, bestScore := Credential{}, -1
+	for _, cred := range c.Credentials {
+		if !strings.EqualFold(cred.Server, server) {
+			continue
+		}
+		score := 0
+		if cred.Ups != "" {
+			if cred.Ups != ups {
+				continue
+			}
+			score += 2
+		}
+		if cred.Port != 0 {
+			if cred.Port != port {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = cred, score
+		}
+	}
+	return best, bestScore >= 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+	"github.com/DRuggeri/nut_exporter/v3/config"
+)
+
+var credentialsReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "nut_exporter",
+	Name:      "credentials_last_reload_successful",
+	Help:      "Whether the credentials and password files were read successfully the last time one of them changed.",
+})
+
+func init() {
+	prometheus.MustRegister(credentialsReloadSuccess)
+}
+
+// credentialStore holds the credentials of the credentials file and the password of the password
+// file. The files are checked for changes whenever credentials are needed, so that rotated
+// secrets are picked up without a restart.
+type credentialStore struct {
+	credentialsFile string
+	passwordFile    string
+	// passwordUser is the command line server and user the password file belongs to
+	passwordUser config.Credential
+
+	mu          sync.Mutex
+	modTimes    map[string]time.Time
+	credentials *config.Credentials
+	password    string
+}
+
+// newCredentialStore reads the files, either of which may be empty. The password of the password
+// file is only used to log in to the server and port of passwordUser as its user.
+func newCredentialStore(credentialsFile, passwordFile string, passwordUser config.Credential) (*credentialStore, error) {
+	s := &credentialStore{
+		credentialsFile: credentialsFile,
+		passwordFile:    passwordFile,
+		passwordUser:    passwordUser,
+		credentials:     &config.Credentials{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.modTimes = s.stat()
+	credentialsReloadSuccess.Set(1)
+	return s, nil
+}
+
+// files returns the files the credentials are read from
+func (s *credentialStore) files() []string {
+	files := s.credentials.Files()
+	for _, file := range []string{s.credentialsFile, s.passwordFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// load reads the files. The current credentials are only replaced if all files could be read.
+func (s *credentialStore) load() error {
+	credentials := &config.Credentials{}
+	if s.credentialsFile != "" {
+		var err error
+		if credentials, err = config.LoadCredentials(s.credentialsFile); err != nil {
+			return err
+		}
+	}
+	password := ""
+	if s.passwordFile != "" {
+		var err error
+		if password, err = config.ReadPasswordFile(s.passwordFile); err != nil {
+			return err
+		}
+	}
+
+	s.credentials = credentials
+	s.password = password
+	return nil
+}
+
+// refresh reloads the files if any of them changed. If they can not be read, the error is logged
+// and the previous credentials are kept until the files change again.
+func (s *credentialStore) refresh() {
+	if maps.EqualFunc(s.modTimes, s.stat(), time.Time.Equal) {
+		return
+	}
+	if err := s.load(); err != nil {
+		logger.Error("Failed to reload credentials, keeping the previous credentials", "err", err)
+		credentialsReloadSuccess.Set(0)
+	} else {
+		logger.Info("Credentials reloaded")
+		credentialsReloadSuccess.Set(1)
+	}
+	s.modTimes = s.stat()
+}
+
+// stat returns the modification times of the files that exist
+func (s *credentialStore) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range s.files() {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// apply sets the credentials of the server and UPS of the options. The password file is the
+// password of the command line user on the command line server, and the credentials file takes
+// precedence over it.
+func (s *credentialStore) apply(opts *collectors.NutCollectorOpts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+
+	if s.passwordFile != "" && opts.Username == s.passwordUser.Username &&
+		strings.EqualFold(opts.Server, s.passwordUser.Server) && opts.ServerPort == s.passwordUser.Port {
+		opts.Password = s.password
+	}
+	if cred, ok := s.credentials.Lookup(opts.Server, opts.ServerPort, opts.Ups); ok {
+		opts.Username = cred.Username
+		opts.Password = cred.Password
+	}
+}
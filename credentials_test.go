@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+	"github.com/DRuggeri/nut_exporter/v3/config"
+)
+
+func TestCredentialStoreReload(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	write := func(password string, modTime time.Time) {
+		if err := os.WriteFile(passwordFile, []byte(password), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(passwordFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	write("first", start)
+
+	store, err := newCredentialStore("", passwordFile, config.Credential{Server: "127.0.0.1", Port: 3493, Username: "monitor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := collectors.NutCollectorOpts{Server: "127.0.0.1", ServerPort: 3493, Username: "monitor"}
+	store.apply(&opts)
+	if opts.Password != "first" {
+		t.Errorf("want password first, have %q", opts.Password)
+	}
+
+	write("second", start.Add(time.Minute))
+	store.apply(&opts)
+	if opts.Password != "second" {
+		t.Errorf("changed password file should be read again, have %q", opts.Password)
+	}
+
+	os.Remove(passwordFile)
+	store.apply(&opts)
+	if opts.Password != "second" {
+		t.Errorf("previous password should be kept when the file can not be read, have %q", opts.Password)
+	}
+}
+
+func TestPasswordFileScope(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newCredentialStore("", passwordFile, config.Credential{Server: "127.0.0.1", Port: 3493, Username: "monitor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, want := range map[config.Credential]string{
+		{Server: "127.0.0.1", Port: 3493, Username: "monitor"}: "secret",
+		{Server: "10.0.0.9", Port: 3493, Username: "monitor"}:  "",
+		{Server: "127.0.0.1", Port: 3494, Username: "monitor"}: "",
+		{Server: "127.0.0.1", Port: 3493, Username: "admin"}:   "",
+	} {
+		opts := collectors.NutCollectorOpts{Server: user.Server, ServerPort: user.Port, Username: user.Username}
+		store.apply(&opts)
+		if opts.Password != want {
+			t.Errorf("%s:%d as %s: want password %q, have %q", user.Server, user.Port, user.Username, want, opts.Password)
+		}
+	}
+
+	//API requests without an API user log in like scrapes
+	defer func(opts collectors.NutCollectorOpts) { collectorOpts = opts }(collectorOpts)
+	collectorOpts = collectors.NutCollectorOpts{Server: "127.0.0.1", ServerPort: 3493, Username: "monitor"}
+	api := &apiHandler{metrics: &metricsHandler{config: &config.Config{}, credentials: store}}
+	opts, err := api.opts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Password != "secret" {
+		t.Errorf("API: want password secret, have %q", opts.Password)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,6 +23,7 @@ import (
 	"github.com/prometheus/exporter-toolkit/web/kingpinflag"
 
 	"github.com/DRuggeri/nut_exporter/v3/collectors"
+	"github.com/DRuggeri/nut_exporter/v3/config"
 )
 
 var Version = "testing"
@@ -31,18 +38,110 @@ var (
 	).Envar("NUT_EXPORTER_SERVERPORT").Default("3493").Int()
 
 	nutUsername = kingpin.Flag(
-		"nut.username", "If set, will authenticate with this username to the server. Password must be set in NUT_EXPORTER_PASSWORD environment variable. ($NUT_EXPORTER_USERNAME)",
+		"nut.username", "If set, will authenticate with this username to the server. Password must be set in NUT_EXPORTER_PASSWORD environment variable or with --nut.password_file. ($NUT_EXPORTER_USERNAME)",
 	).Envar("NUT_EXPORTER_USERNAME").String()
 	nutPassword = ""
 
+	nutPasswordFile = kingpin.Flag(
+		"nut.password_file", "File holding the password of --nut.username, such as a Docker or Kubernetes secret. It is read again when it changes. ($NUT_EXPORTER_PASSWORD_FILE)",
+	).Envar("NUT_EXPORTER_PASSWORD_FILE").Default("").String()
+
+	credentialsFile = kingpin.Flag(
+		"nut.credentials_file", "YAML file mapping NUT servers and UPS devices to the username and password to log in with. It is read again when it changes. ($NUT_EXPORTER_CREDENTIALS_FILE)",
+	).Envar("NUT_EXPORTER_CREDENTIALS_FILE").Default("").String()
+
+	disableOverrides = kingpin.Flag(
+		"nut.disable_overrides", "A comma-separated list of query string parameters (ups, server, serverport, username, password, variables, statuses) that scrapes may not set, or all. ($NUT_EXPORTER_DISABLE_OVERRIDES)",
+	).Envar("NUT_EXPORTER_DISABLE_OVERRIDES").Default("").String()
+
+	allowedServers = kingpin.Flag(
+		"nut.allowed_servers", "A comma-separated list of hostnames, IP addresses and CIDR ranges of the NUT servers scrapes may select with the server query string parameter. Empty allows any server. ($NUT_EXPORTER_ALLOWED_SERVERS)",
+	).Envar("NUT_EXPORTER_ALLOWED_SERVERS").Default("").String()
+
+	allowedPorts = kingpin.Flag(
+		"nut.allowed_ports", "A comma-separated list of the ports scrapes selecting a NUT server with the server or serverport query string parameters may connect to. Empty allows any port. ($NUT_EXPORTER_ALLOWED_PORTS)",
+	).Envar("NUT_EXPORTER_ALLOWED_PORTS").Default("").String()
+
 	disableDeviceInfo = kingpin.Flag(
 		"nut.disable_device_info", "A flag to disable the generation of the device_info meta metric. ($NUT_EXPORTER_DISABLE_DEVICE_INFO)",
 	).Envar("NUT_EXPORTER_DISABLE_DEVICE_INFO").Default("false").Bool()
 
+	deviceLabels = kingpin.Flag(
+		"nut.device_labels", "A comma-separated list of labels of the device_info metric. Names without a dot are read from device.NAME, others such as ups.firmware or driver.name from the variable of that name. ($NUT_EXPORTER_DEVICE_LABELS)",
+	).Envar("NUT_EXPORTER_DEVICE_LABELS").Default(strings.Join(collectors.DefaultDeviceLabels, ",")).String()
+
+	identityLabels = kingpin.Flag(
+		"nut.identity_labels", "A comma-separated list of device labels, such as location, to add to every metric read from the UPS. ($NUT_EXPORTER_IDENTITY_LABELS)",
+	).Envar("NUT_EXPORTER_IDENTITY_LABELS").Default("").String()
+
+	multiUps = kingpin.Flag(
+		"nut.multi_ups", "A flag to export all UPS devices found on the NUT server in one scrape with a ups label instead of failing the scrape. ($NUT_EXPORTER_MULTI_UPS)",
+	).Envar("NUT_EXPORTER_MULTI_UPS").Default("false").Bool()
+
+	inventory = kingpin.Flag(
+		"nut.inventory", "A flag to export the instant commands and writable variables of the UPS as command_info and variable_writable metrics. This adds two requests to the NUT server per UPS and scrape. ($NUT_EXPORTER_INVENTORY)",
+	).Envar("NUT_EXPORTER_INVENTORY").Default("false").Bool()
+
+	clients = kingpin.Flag(
+		"nut.clients", "A flag to export the number of clients logged in to the UPS and their addresses as clients_connected and client_info metrics. ($NUT_EXPORTER_CLIENTS)",
+	).Envar("NUT_EXPORTER_CLIENTS").Default("false").Bool()
+
+	variableOutput = kingpin.Flag(
+		"nut.variable_output", "How variables are exported. per-variable exports a metric named after each variable, generic exports one variable metric with a variable label (and variable_info for strings), both does both. ($NUT_EXPORTER_VARIABLE_OUTPUT)",
+	).Envar("NUT_EXPORTER_VARIABLE_OUTPUT").Default(collectors.VariableOutputPerVariable).Enum(collectors.VariableOutputs...)
+
+	nutTLS = kingpin.Flag(
+		"nut.tls", "A flag to upgrade connections to the NUT server with STARTTLS. Connections continue in plain text if the server does not offer TLS. ($NUT_EXPORTER_TLS)",
+	).Envar("NUT_EXPORTER_TLS").Default("false").Bool()
+
+	nutTLSRequired = kingpin.Flag(
+		"nut.tls_required", "A flag to fail scrapes if the NUT server does not offer TLS. Implies --nut.tls. ($NUT_EXPORTER_TLS_REQUIRED)",
+	).Envar("NUT_EXPORTER_TLS_REQUIRED").Default("false").Bool()
+
+	nutTLSCAFile = kingpin.Flag(
+		"nut.tls_ca_file", "Path to a PEM bundle of the certificate authorities used to verify the NUT server. Defaults to the system bundle. ($NUT_EXPORTER_TLS_CA_FILE)",
+	).Envar("NUT_EXPORTER_TLS_CA_FILE").String()
+
+	nutTLSCertFile = kingpin.Flag(
+		"nut.tls_cert_file", "Path to a PEM client certificate presented to the NUT server. ($NUT_EXPORTER_TLS_CERT_FILE)",
+	).Envar("NUT_EXPORTER_TLS_CERT_FILE").String()
+
+	nutTLSKeyFile = kingpin.Flag(
+		"nut.tls_key_file", "Path to the PEM key of the client certificate. ($NUT_EXPORTER_TLS_KEY_FILE)",
+	).Envar("NUT_EXPORTER_TLS_KEY_FILE").String()
+
+	nutTLSServerName = kingpin.Flag(
+		"nut.tls_server_name", "Name expected in the certificate of the NUT server. Defaults to the server name. ($NUT_EXPORTER_TLS_SERVER_NAME)",
+	).Envar("NUT_EXPORTER_TLS_SERVER_NAME").String()
+
+	nutTLSInsecureSkipVerify = kingpin.Flag(
+		"nut.tls_insecure_skip_verify", "A flag to disable verification of the certificate of the NUT server. ($NUT_EXPORTER_TLS_INSECURE_SKIP_VERIFY)",
+	).Envar("NUT_EXPORTER_TLS_INSECURE_SKIP_VERIFY").Default("false").Bool()
+
 	enableFilter = kingpin.Flag(
 		"nut.vars_enable", "A comma-separated list of variable names to monitor. See the variable notes in README. ($NUT_EXPORTER_VARIABLES)",
 	).Envar("NUT_EXPORTER_VARIABLES").Default("battery.charge,battery.voltage,battery.voltage.nominal,input.voltage,input.voltage.nominal,ups.load,ups.status").String()
 
+	stringVars = kingpin.Flag(
+		"nut.string_vars", "A comma-separated list of variables with string values, such as battery.type or driver.version, to export as NAME_info metrics with the value in a value label. ($NUT_EXPORTER_STRING_VARIABLES)",
+	).Envar("NUT_EXPORTER_STRING_VARIABLES").Default("").String()
+
+	stringMaxLength = kingpin.Flag(
+		"nut.string_max_length", "Maximum length of string values exported in labels. Longer values are truncated. 0 disables the limit. ($NUT_EXPORTER_STRING_MAX_LENGTH)",
+	).Envar("NUT_EXPORTER_STRING_MAX_LENGTH").Default("64").Int()
+
+	stringMaxSeries = kingpin.Flag(
+		"nut.string_max_series", "Maximum number of series with string values exported per scrape. Further strings are dropped with a warning. 0 disables the limit. ($NUT_EXPORTER_STRING_MAX_SERIES)",
+	).Envar("NUT_EXPORTER_STRING_MAX_SERIES").Default("50").Int()
+
+	dateVars = kingpin.Flag(
+		"nut.date_vars", "A comma-separated list of variables holding dates, such as YYYY/MM/DD or MM/DD/YY, to export as NAME_timestamp_seconds metrics. ($NUT_EXPORTER_DATE_VARIABLES)",
+	).Envar("NUT_EXPORTER_DATE_VARIABLES").Default("battery.date,battery.mfr.date,ups.mfr.date,battery.date.maintenance").String()
+
+	durationVars = kingpin.Flag(
+		"nut.duration_vars", "A comma-separated list of variables holding durations, as seconds, HH:MM:SS or values like 1h30m, to export as NAME_seconds metrics. ($NUT_EXPORTER_DURATION_VARIABLES)",
+	).Envar("NUT_EXPORTER_DURATION_VARIABLES").Default("").String()
+
 	onRegex = kingpin.Flag(
 		"nut.on_regex", "This regular expression will be used to determine if the var's value should be coaxed to 1 if it is a string. Match is case-insensitive. ($NUT_EXPORTER_ON_REGEX)",
 	).Envar("NUT_EXPORTER_ON_REGEX").Default("^(enable|enabled|on|true|active|activated)$").String()
@@ -55,10 +154,46 @@ var (
 		"nut.statuses", "A comma-separated list of statuses labels that will always be set by the exporter. If NUT does not set these flags, the exporter will force the network_ups_tools_ups_status{flag=\"NAME\"} to 0. See the ups.status notes in README.' ($NUT_EXPORTER_STATUSES)",
 	).Envar("NUT_EXPORTER_STATUSES").Default("OL,OB,LB,HB,RB,CHRG,DISCHRG,BYPASS,CAL,OFF,OVER,TRIM,BOOST,FSD,SD").String()
 
+	defaultScrapeTimeout = kingpin.Flag(
+		"nut.scrape_timeout", "Time allowed for reading from the NUT server when Prometheus does not send the X-Prometheus-Scrape-Timeout-Seconds header. 0 disables the timeout. ($NUT_EXPORTER_SCRAPE_TIMEOUT)",
+	).Envar("NUT_EXPORTER_SCRAPE_TIMEOUT").Default("10s").Duration()
+
+	timeoutOffset = kingpin.Flag(
+		"nut.timeout_offset", "Time subtracted from the X-Prometheus-Scrape-Timeout-Seconds header sent by Prometheus to leave room for sending the response. ($NUT_EXPORTER_TIMEOUT_OFFSET)",
+	).Envar("NUT_EXPORTER_TIMEOUT_OFFSET").Default("500ms").Duration()
+
+	cacheTTL = kingpin.Flag(
+		"cache.ttl", "Time after which the collector of a scrape that has not been repeated is dropped. 0 keeps collectors forever. ($NUT_EXPORTER_CACHE_TTL)",
+	).Envar("NUT_EXPORTER_CACHE_TTL").Default("1h").Duration()
+
+	cacheMaxEntries = kingpin.Flag(
+		"cache.max_entries", "Maximum number of collectors kept for distinct scrape settings. The least recently used collector is dropped beyond it. 0 disables the limit. ($NUT_EXPORTER_CACHE_MAX_ENTRIES)",
+	).Envar("NUT_EXPORTER_CACHE_MAX_ENTRIES").Default("1000").Int()
+
+	pollInterval = kingpin.Flag(
+		"nut.poll_interval", "If set, the NUT server is read in the background at this interval and scrapes are served the latest snapshot instead of reading it. 0 reads the NUT server on every scrape. ($NUT_EXPORTER_POLL_INTERVAL)",
+	).Envar("NUT_EXPORTER_POLL_INTERVAL").Default("0s").Duration()
+
+	pollMaxAge = kingpin.Flag(
+		"nut.poll_max_age", "Age after which a snapshot is no longer served in polling mode and up is reported as 0. 0 allows three poll intervals. ($NUT_EXPORTER_POLL_MAX_AGE)",
+	).Envar("NUT_EXPORTER_POLL_MAX_AGE").Default("0s").Duration()
+
+	configFile = kingpin.Flag(
+		"config.file", "Path to a YAML or JSON file defining named targets that can be scraped with the target query string parameter. See the configuration file notes in README. ($NUT_EXPORTER_CONFIG_FILE)",
+	).Envar("NUT_EXPORTER_CONFIG_FILE").String()
+
 	metricsNamespace = kingpin.Flag(
 		"metrics.namespace", "Metrics Namespace ($NUT_EXPORTER_METRICS_NAMESPACE)",
 	).Envar("NUT_EXPORTER_METRICS_NAMESPACE").Default("network_ups_tools").String()
 
+	metricNaming = kingpin.Flag(
+		"metrics.naming", "How metrics named after variables are named. legacy uses the variable name only, conventional adds unit suffixes and converts percentages to ratios for known variables, both exports both names. ($NUT_EXPORTER_METRICS_NAMING)",
+	).Envar("NUT_EXPORTER_METRICS_NAMING").Default(collectors.MetricNamingLegacy).Enum(collectors.MetricNamings...)
+
+	counterVars = kingpin.Flag(
+		"nut.counter_vars", "A comma-separated list of variables, or patterns such as *.count, that only ever increase. They are exported as NAME_total counters, and with --metrics.naming=legacy also as gauges under their legacy names. ($NUT_EXPORTER_COUNTER_VARIABLES)",
+	).Envar("NUT_EXPORTER_COUNTER_VARIABLES").Default(strings.Join(collectors.DefaultCounterVariables, ",")).String()
+
 	tookitFlags = kingpinflag.AddFlags(kingpin.CommandLine, ":9199")
 
 	metricsPath = kingpin.Flag(
@@ -69,6 +204,31 @@ var (
 		"web.exporter-telemetry-path", "Path under which to expose process metrics about this exporter ($NUT_EXPORTER_WEB_EXPORTER_TELEMETRY_PATH)",
 	).Envar("NUT_EXPORTER_WEB_EXPORTER_TELEMETRY_PATH").Default("/metrics").String()
 
+	enableLifecycle = kingpin.Flag(
+		"web.enable-lifecycle", "Enable reloading the configuration file with an HTTP POST to /-/reload. SIGHUP always reloads it. ($NUT_EXPORTER_WEB_ENABLE_LIFECYCLE)",
+	).Envar("NUT_EXPORTER_WEB_ENABLE_LIFECYCLE").Default("false").Bool()
+
+	apiEnable = kingpin.Flag(
+		"api.enable", "A flag to enable the HTTP API for running instant commands and setting variables. Requests must carry the token set in the NUT_EXPORTER_API_TOKEN environment variable. See the API notes in README. ($NUT_EXPORTER_API_ENABLE)",
+	).Envar("NUT_EXPORTER_API_ENABLE").Default("false").Bool()
+
+	apiCommands = kingpin.Flag(
+		"api.commands", "A comma-separated list of instant commands, or patterns such as test.battery.*, that may be run through the API. ($NUT_EXPORTER_API_COMMANDS)",
+	).Envar("NUT_EXPORTER_API_COMMANDS").Default("").String()
+
+	apiVariables = kingpin.Flag(
+		"api.variables", "A comma-separated list of writable variables, or patterns such as input.transfer.*, that may be set through the API. ($NUT_EXPORTER_API_VARIABLES)",
+	).Envar("NUT_EXPORTER_API_VARIABLES").Default("").String()
+
+	apiUsername = kingpin.Flag(
+		"api.username", "NUT user allowed to run instant commands and set variables that is used by the API instead of --nut.username. Password must be set in NUT_EXPORTER_API_PASSWORD environment variable. ($NUT_EXPORTER_API_USERNAME)",
+	).Envar("NUT_EXPORTER_API_USERNAME").String()
+	apiPassword = ""
+
+	apiTimeout = kingpin.Flag(
+		"api.timeout", "Time to wait for the driver to report the result of an API request. ($NUT_EXPORTER_API_TIMEOUT)",
+	).Envar("NUT_EXPORTER_API_TIMEOUT").Default("10s").Duration()
+
 	printMetrics = kingpin.Flag(
 		"printMetrics", "Print the metrics this exporter exposes and exits. Default: false ($NUT_EXPORTER_PRINT_METRICS)",
 	).Envar("NUT_EXPORTER_PRINT_METRICS").Default("false").Bool()
@@ -89,64 +249,216 @@ func init() {
 	prometheus.MustRegister(promcollectors.NewBuildInfoCollector())
 }
 
+var errUnknownTarget = errors.New("unknown target")
+
+type cachedHandler struct {
+	handler   http.Handler
+	collector *collectors.NutCollector
+	query     url.Values
+	opts      collectors.NutCollectorOpts
+}
+
 type metricsHandler struct {
-	handlers map[string]*http.Handler
+	mu       sync.Mutex
+	handlers *handlerCache
+	config   *config.Config
+	// generation is incremented by every reload of the configuration
+	generation uint64
+	// batteryTests runs the battery tests of the targets, if set
+	batteryTests *collectors.BatteryTestScheduler
+	// credentials holds the credentials and password files
+	credentials *credentialStore
+	// overrides restricts the query string parameters of scrapes
+	overrides *overridePolicy
+	// discovered holds the UPS devices last listed by service discovery, by source
+	discovered map[string][]collectors.DiscoveredUPS
 }
 
-func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// collectorOpts resolves the collector options for a scrape from the command line flags, the
+// configuration file and the query string parameters
+func (h *metricsHandler) collectorOpts(query url.Values) (collectors.NutCollectorOpts, error) {
 	thisCollectorOpts := collectorOpts
-	thisCollectorOpts.Ups = r.URL.Query().Get("ups")
+	thisCollectorOpts.Mappings = h.config.Mappings
+	targetUser := false
+
+	if target := query.Get("target"); target != "" {
+		targetConfig, ok := h.config.Targets[target]
+		if !ok {
+			return thisCollectorOpts, errUnknownTarget
+		}
+		thisCollectorOpts = targetConfig.Apply(thisCollectorOpts)
+		targetUser = targetConfig.Username != ""
+	}
+
+	if query.Get("ups") != "" {
+		thisCollectorOpts.Ups = query.Get("ups")
+	}
 
-	if r.URL.Query().Get("server") != "" {
-		thisCollectorOpts.Server = r.URL.Query().Get("server")
+	if query.Get("server") != "" {
+		thisCollectorOpts.Server = query.Get("server")
 	}
 
-	if r.URL.Query().Get("serverport") != "" {
-		if port, err := strconv.Atoi(r.URL.Query().Get("serverport")); err != nil {
+	if query.Get("serverport") != "" {
+		if port, err := strconv.Atoi(query.Get("serverport")); err == nil {
 			thisCollectorOpts.ServerPort = port
 		}
 	}
 
-	if r.URL.Query().Get("username") != "" {
-		thisCollectorOpts.Username = r.URL.Query().Get("username")
+	//Users of targets take precedence over the credential files
+	if !targetUser && h.credentials != nil {
+		h.credentials.apply(&thisCollectorOpts)
+	}
+
+	if query.Get("username") != "" {
+		thisCollectorOpts.Username = query.Get("username")
+	}
+
+	if query.Get("password") != "" {
+		thisCollectorOpts.Password = query.Get("password")
 	}
 
-	if r.URL.Query().Get("password") != "" {
-		thisCollectorOpts.Password = r.URL.Query().Get("password")
+	if query.Get("variables") != "" {
+		thisCollectorOpts.Variables = strings.Split(query.Get("variables"), ",")
 	}
 
-	if r.URL.Query().Get("variables") != "" {
-		thisCollectorOpts.Variables = strings.Split(r.URL.Query().Get("variables"), ",")
+	if query.Get("statuses") != "" {
+		thisCollectorOpts.Statuses = strings.Split(query.Get("statuses"), ",")
 	}
 
-	if r.URL.Query().Get("statuses") != "" {
-		thisCollectorOpts.Statuses = strings.Split(r.URL.Query().Get("statuses"), ",")
+	return thisCollectorOpts, nil
+}
+
+// scrapeTimeout returns the time a scrape may spend reading from NUT, preferring the timeout
+// announced by Prometheus over the default
+func scrapeTimeout(r *http.Request, defaultTimeout, offset time.Duration) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return defaultTimeout
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		logger.Debug("Ignoring invalid scrape timeout header", "value", header)
+		return defaultTimeout
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return timeout
+}
+
+// scrapeHandler serves the metrics of the collector. The collector is registered anew for every
+// scrape so that NUT requests are cancelled when the scrape times out or Prometheus goes away.
+func scrapeHandler(nutCollector *collectors.NutCollector, registry *prometheus.Registry) http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if timeout := scrapeTimeout(r, *defaultScrapeTimeout, *timeoutOffset); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		scrapeRegistry := prometheus.NewRegistry()
+		scrapeRegistry.MustRegister(nutCollector.WithContext(ctx))
+		promhttp.HandlerFor(prometheus.Gatherers{registry, scrapeRegistry}, promhttp.HandlerOpts{Registry: registry}).ServeHTTP(w, r)
+	})
+	return promhttp.InstrumentMetricHandler(registry, handler)
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	target := query.Get("target")
+
+	h.mu.Lock()
+	thisCollectorOpts, err := h.collectorOpts(query)
+	generation := h.generation
+	h.mu.Unlock()
+	if err == errUnknownTarget {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - Unknown target"))
+		logger.Warn("Scrape requested for unknown target", "target", target)
+		return
+	}
+	if reason := h.overrides.check(query, thisCollectorOpts); reason != "" {
+		rejectedScrapes.WithLabelValues(reason).Inc()
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden: " + reason))
+		logger.Warn("Scrape rejected", "reason", reason, "server", thisCollectorOpts.Server, "port", thisCollectorOpts.ServerPort, "remote", r.RemoteAddr)
+		return
 	}
 
-	var promHandler http.Handler
 	cacheName := fmt.Sprintf("%s:%d/%s", thisCollectorOpts.Server, thisCollectorOpts.ServerPort, thisCollectorOpts.Ups)
-	if tmp, ok := h.handlers[cacheName]; ok {
+	if target != "" {
+		cacheName = fmt.Sprintf("%s (target %s)", cacheName, target)
+	}
+
+	cacheKey := cacheKey(target, thisCollectorOpts)
+	cached, ok := h.handlers.get(cacheKey)
+	if ok {
 		logger.Debug(fmt.Sprintf("Using existing handler for UPS `%s`", cacheName))
-		promHandler = *tmp
 	} else {
 		//Build a custom registry to include only the UPS metrics on the UPS metrics path
 		logger.Info(fmt.Sprintf("Creating new registry, handler, and collector for UPS `%s`", cacheName))
 		registry := prometheus.NewRegistry()
-		promHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
-		promHandler = promhttp.InstrumentMetricHandler(registry, promHandler)
 
-		nutCollector, err := collectors.NewNutCollector(thisCollectorOpts, logger)
+		//The UPS name is checked against the NUT server within the time allowed for the scrape
+		ctx := r.Context()
+		if timeout := scrapeTimeout(r, *defaultScrapeTimeout, *timeoutOffset); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		nutCollector, err := collectors.NewNutCollector(ctx, thisCollectorOpts, logger)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("500 - InternalServer Error"))
 			logger.Error("Internal server error", "err", err)
 			return
 		}
-		registry.MustRegister(nutCollector)
-		h.handlers[cacheName] = &promHandler
+
+		if h.batteryTests != nil && target != "" {
+			registry.MustRegister(h.batteryTests.Collector(target, thisCollectorOpts))
+		}
+
+		cached = &cachedHandler{
+			handler:   scrapeHandler(nutCollector, registry),
+			collector: nutCollector,
+			query:     query,
+			opts:      thisCollectorOpts,
+		}
+
+		//A reload while the collector was built may have changed the options of the scrape, in
+		//which case the collector only serves this scrape
+		h.mu.Lock()
+		current := thisCollectorOpts
+		if h.generation != generation {
+			current, err = h.collectorOpts(query)
+		}
+		if err == nil && reflect.DeepEqual(current, thisCollectorOpts) {
+			cached = h.handlers.add(cacheKey, cacheName, cached)
+		} else {
+			logger.Info(fmt.Sprintf("Not caching handler for UPS `%s` built before a configuration change", cacheName))
+			defer nutCollector.Close()
+		}
+		h.mu.Unlock()
 	}
 
-	promHandler.ServeHTTP(w, r)
+	cached.handler.ServeHTTP(w, r)
+}
+
+// splitVariables splits a comma-separated list of variable names
+func splitVariables(list string) []string {
+	variables := []string{}
+	for _, varName := range strings.Split(list, ",") {
+		// Be nice and clear spaces for those that like them
+		variable := strings.Trim(varName, " ")
+		if variable == "" {
+			continue
+		}
+		variables = append(variables, variable)
+	}
+	return variables
 }
 
 func main() {
@@ -175,14 +487,24 @@ func main() {
 		slog.SetDefault(logger)
 	}
 
-	if *nutUsername != "" {
+	if *nutUsername != "" && *nutPasswordFile == "" {
 		logger.Debug("Authenticating to NUT server")
 		nutPassword = os.Getenv("NUT_EXPORTER_PASSWORD")
-		if nutPassword == "" {
+		//The credentials file may hold the password of the command line server instead
+		if nutPassword == "" && *credentialsFile == "" {
 			logger.Error("Username set, but NUT_EXPORTER_PASSWORD environment variable missing. Cannot authenticate!")
 			os.Exit(2)
 		}
 	}
+	if *nutPasswordFile != "" && os.Getenv("NUT_EXPORTER_PASSWORD") != "" {
+		logger.Error("Only one of NUT_EXPORTER_PASSWORD and --nut.password_file may be set")
+		os.Exit(2)
+	}
+	credentials, err := newCredentialStore(*credentialsFile, *nutPasswordFile, config.Credential{Server: *server, Port: *serverport, Username: *nutUsername})
+	if err != nil {
+		logger.Error("Failed to read credentials", "err", err)
+		os.Exit(2)
+	}
 
 	variables := []string{}
 	hasUpsStatusVariable := false
@@ -204,6 +526,23 @@ func main() {
 		logger.Warn("Exporter has been started without `ups.status` variable to be exported with --nut.vars_enable. Online/offline/etc statuses will not be reported!")
 	}
 
+	stringVariables := splitVariables(*stringVars)
+	dateVariables := splitVariables(*dateVars)
+	durationVariables := splitVariables(*durationVars)
+	counterVariables := splitVariables(*counterVars)
+	deviceLabelList := splitVariables(*deviceLabels)
+	identityLabelList := splitVariables(*identityLabels)
+	if err := collectors.ValidateDeviceLabels(deviceLabelList, identityLabelList); err != nil {
+		logger.Error("Invalid device labels", "err", err)
+		os.Exit(2)
+	}
+
+	overrides, err := newOverridePolicy(splitVariables(*disableOverrides), splitVariables(*allowedServers), splitVariables(*allowedPorts))
+	if err != nil {
+		logger.Error("Invalid query string restrictions", "err", err)
+		os.Exit(2)
+	}
+
 	statuses := []string{}
 	for _, status := range strings.Split(*statusList, ",") {
 		// Be nice and clear spaces for those that like them
@@ -221,11 +560,45 @@ func main() {
 		Username:          *nutUsername,
 		Password:          nutPassword,
 		DisableDeviceInfo: *disableDeviceInfo,
+		MultiUps:          *multiUps,
+		DeviceLabels:      deviceLabelList,
+		IdentityLabels:    identityLabelList,
+		Inventory:         *inventory,
+		Clients:           *clients,
+		VariableOutput:    *variableOutput,
+		MetricNaming:      *metricNaming,
+		CounterVariables:  counterVariables,
+		StringVariables:   stringVariables,
+		StringMaxLength:   *stringMaxLength,
+		StringMaxSeries:   *stringMaxSeries,
+		DateVariables:     dateVariables,
+		DurationVariables: durationVariables,
 		Variables:         variables,
 		Statuses:          statuses,
 		OnRegex:           *onRegex,
 		OffRegex:          *offRegex,
+		PollInterval:      *pollInterval,
+		PollMaxAge:        *pollMaxAge,
+
+		TLS:                   *nutTLS,
+		TLSRequired:           *nutTLSRequired,
+		TLSCAFile:             *nutTLSCAFile,
+		TLSCertFile:           *nutTLSCertFile,
+		TLSKeyFile:            *nutTLSKeyFile,
+		TLSServerName:         *nutTLSServerName,
+		TLSInsecureSkipVerify: *nutTLSInsecureSkipVerify,
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("Failed to load configuration file", "file", *configFile, "err", err)
+		os.Exit(2)
 	}
+	if *configFile != "" {
+		logger.Info("Loaded configuration file", "file", *configFile, "targets", len(cfg.Targets))
+	}
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
 
 	if *printMetrics {
 		/* Make a channel and function to send output along */
@@ -247,7 +620,7 @@ func main() {
 		   - When the describe function exits after returning the last item, close the channel to end the background consume function
 		*/
 		fmt.Println("NUT")
-		nutCollector, _ := collectors.NewNutCollector(collectorOpts, logger)
+		nutCollector, _ := collectors.NewNutCollector(context.Background(), collectorOpts, logger)
 		out = make(chan *prometheus.Desc)
 		go eatOutput(out)
 		nutCollector.Describe(out)
@@ -259,11 +632,35 @@ func main() {
 	logger.Info("Starting nut_exporter", "version", Version)
 
 	handler := &metricsHandler{
-		handlers: make(map[string]*http.Handler),
+		handlers:     newHandlerCache(*cacheTTL, *cacheMaxEntries),
+		overrides:    overrides,
+		credentials:  credentials,
+		discovered:   make(map[string][]collectors.DiscoveredUPS),
+		config:       cfg,
+		batteryTests: collectors.NewBatteryTestScheduler(logger),
+	}
+	if err := handler.batteryTests.Update(batteryTests(cfg, credentials)); err != nil {
+		logger.Error("Failed to schedule battery tests", "err", err)
+		os.Exit(2)
 	}
+	go handler.watchReloads()
+	go handler.handlers.expireLoop()
 
 	http.Handle(*metricsPath, handler)
 	http.Handle(*exporterMetricsPath, promhttp.Handler())
+	http.HandleFunc("/-/reload", handler.reloadHandler)
+	http.HandleFunc("/sd", handler.sdHandler)
+	if *apiEnable {
+		api, err := newAPIHandler(handler)
+		if err != nil {
+			logger.Error("Failed to enable the API", "err", err)
+			os.Exit(2)
+		}
+		http.HandleFunc("POST /api/v1/ups/{name}/commands/{command}", api.commandHandler)
+		http.HandleFunc("GET /api/v1/ups/{name}/variables", api.variablesHandler)
+		http.HandleFunc("POST /api/v1/ups/{name}/variables/{variable}", api.setHandler)
+		logger.Info("API enabled", "commands", strings.Join(api.commands, ","), "variables", strings.Join(api.variables, ","))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>NUT Exporter</title></head>
@@ -271,6 +668,7 @@ func main() {
              <h1>NUT Exporter</h1>
              <p><a href='` + *metricsPath + `'>UPS metrics</a></p>
              <p><a href='` + *exporterMetricsPath + `'>Exporter metrics</a></p>
+             <p><a href='/sd'>Service discovery</a></p>
              </body>
              </html>`))
 	})
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"testing"
@@ -36,6 +37,24 @@ func TestSuccessfulLaunch(t *testing.T) {
 	}
 }
 
+func TestScrapeTimeout(t *testing.T) {
+	for header, want := range map[string]time.Duration{
+		"":        10 * time.Second,
+		"15":      14500 * time.Millisecond,
+		"0.25":    250 * time.Millisecond,
+		"invalid": 10 * time.Second,
+		"-1":      10 * time.Second,
+	} {
+		r := httptest.NewRequest("GET", "/ups_metrics", nil)
+		if header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+		}
+		if have := scrapeTimeout(r, 10*time.Second, 500*time.Millisecond); have != want {
+			t.Errorf("header %q: want %s, have %s", header, want, have)
+		}
+	}
+}
+
 func queryExporter(address string) error {
 	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", address))
 	if err != nil {
@@ -0,0 +1,327 @@
+// Package nutclient implements a client for the network protocol of the
+// Network UPS Tools server (upsd).
+//
+// See https://networkupstools.org/docs/developer-guide.chunked/net-protocol.html
+// for the description of the protocol. Every method takes a context which
+// bounds the time spent waiting on the server. A Client is safe for
+// concurrent use, but commands are sent one at a time.
+package nutclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the port upsd listens on unless configured otherwise
+const DefaultPort = 3493
+
+// Client is a connection to a NUT server
+type Client struct {
+	mu     sync.Mutex
+	host   string
+	conn   net.Conn
+	reader *bufio.Reader
+	tls    bool
+	// err is set once the connection failed in a way that may have left the
+	// protocol stream out of sync. Every further command fails with it.
+	err error
+}
+
+// Dial connects to the NUT server at address, which is a host:port pair
+func Dial(ctx context.Context, address string) (*Client, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(conn)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		client.host = host
+	}
+	return client, nil
+}
+
+// NewClient returns a client speaking the NUT protocol over an established connection
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Close closes the connection without logging out
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	return c.conn.Close()
+}
+
+// TLS reports whether the connection was upgraded with StartTLS
+func (c *Client) TLS() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tls
+}
+
+// StartTLS upgrades the connection to TLS. If config does not set a
+// ServerName, the host the client was dialed with is used.
+func (c *Client) StartTLS(ctx context.Context, config *tls.Config) error {
+	var tlsConn *tls.Conn
+	err := c.roundTrip(ctx, func() error {
+		if c.tls {
+			return &Error{Code: "ALREADY-SSL-MODE"}
+		}
+		line, err := c.command("STARTTLS")
+		if err != nil {
+			return err
+		}
+		if line != "OK STARTTLS" {
+			return c.unexpected(line)
+		}
+
+		config = config.Clone()
+		if config.ServerName == "" {
+			config.ServerName = c.host
+		}
+		tlsConn = tls.Client(c.conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			c.err = err
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The connection is only replaced once roundTrip no longer watches ctx
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.tls = true
+	return nil
+}
+
+// roundTrip runs fn with exclusive access to the connection and with I/O
+// deadlines following ctx
+func (c *Client) roundTrip(ctx context.Context, fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	conn := c.conn
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		// Unblock any pending read or write
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	err := fn()
+	var nutErr *Error
+	if err != nil && !errors.As(err, &nutErr) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		} else if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+			// The connection deadline may expire just before the context does
+			err = context.DeadlineExceeded
+		}
+		c.err = err
+	}
+	return err
+}
+
+// command sends a request and reads a single line response. ERR responses
+// are returned as *Error.
+func (c *Client) command(args ...string) (string, error) {
+	if _, err := c.conn.Write([]byte(encodeLine(args) + "\n")); err != nil {
+		return "", err
+	}
+	return c.readLine()
+}
+
+func (c *Client) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "ERR ") {
+		fields := strings.SplitN(line, " ", 3)
+		nutErr := &Error{Code: fields[1]}
+		if len(fields) > 2 {
+			nutErr.Extra = fields[2]
+		}
+		return "", nutErr
+	}
+	return line, nil
+}
+
+// get sends a GET-like request and returns the fields of the response that
+// follow the echo of the request arguments
+func (c *Client) get(ctx context.Context, args ...string) ([]string, error) {
+	var result []string
+	err := c.roundTrip(ctx, func() error {
+		line, err := c.command(args...)
+		if err != nil {
+			return err
+		}
+		fields, err := splitLine(line)
+		if err != nil {
+			return err
+		}
+		result, err = stripPrefix(fields, args[1:])
+		if err != nil {
+			return c.unexpected(line)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// list sends a LIST request and returns the fields of every item that follow
+// the echo of the request arguments
+func (c *Client) list(ctx context.Context, args ...string) ([][]string, error) {
+	var result [][]string
+	err := c.roundTrip(ctx, func() error {
+		line, err := c.command(args...)
+		if err != nil {
+			return err
+		}
+		header := encodeLine(args)
+		if line != "BEGIN "+header {
+			return c.unexpected(line)
+		}
+
+		for {
+			line, err := c.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "END "+header {
+				return nil
+			}
+			fields, err := splitLine(line)
+			if err != nil {
+				return err
+			}
+			item, err := stripPrefix(fields, args[1:])
+			if err != nil {
+				return c.unexpected(line)
+			}
+			result = append(result, item)
+		}
+	})
+	return result, err
+}
+
+// simple sends a request that is answered with OK
+func (c *Client) simple(ctx context.Context, args ...string) error {
+	return c.roundTrip(ctx, func() error {
+		line, err := c.command(args...)
+		if err != nil {
+			return err
+		}
+		if line != "OK" {
+			return c.unexpected(line)
+		}
+		return nil
+	})
+}
+
+// unexpected marks the stream as out of sync and returns the error describing why
+func (c *Client) unexpected(line string) error {
+	c.err = fmt.Errorf("unexpected response from NUT server: %q", line)
+	return c.err
+}
+
+// stripPrefix removes the echo of the request arguments from a response
+func stripPrefix(fields []string, prefix []string) ([]string, error) {
+	if len(fields) < len(prefix) {
+		return nil, errors.New("short response")
+	}
+	for i, want := range prefix {
+		if fields[i] != want {
+			return nil, errors.New("mismatched response")
+		}
+	}
+	return fields[len(prefix):], nil
+}
+
+// splitLine splits a protocol line into fields, removing the quotes and
+// escapes of quoted fields
+func splitLine(line string) ([]string, error) {
+	fields := []string{}
+	var field strings.Builder
+	inField, inQuotes, escaped := false, false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inField = true
+		case r == '"':
+			if inQuotes {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if inQuotes || escaped {
+		return nil, fmt.Errorf("unterminated field in %q", line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// encodeLine joins arguments into a protocol line, quoting those that need it
+func encodeLine(args []string) string {
+	encoded := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \"\\\t") {
+			encoded[i] = arg
+			continue
+		}
+		arg = strings.ReplaceAll(arg, `\`, `\\`)
+		arg = strings.ReplaceAll(arg, `"`, `\"`)
+		encoded[i] = `"` + arg + `"`
+	}
+	return strings.Join(encoded, " ")
+}
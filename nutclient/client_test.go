@@ -0,0 +1,403 @@
+package nutclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUpsd answers every request line found in responses with the given
+// lines. A request mapped to nil is never answered. STARTTLS is accepted if
+// tlsConfig is set.
+type fakeUpsd struct {
+	listener  net.Listener
+	responses map[string][]string
+	tlsConfig *tls.Config
+}
+
+func newFakeUpsd(t *testing.T, responses map[string][]string) *fakeUpsd {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeUpsd{listener: listener, responses: responses}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeUpsd) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "STARTTLS" && s.tlsConfig != nil {
+			conn.Write([]byte("OK STARTTLS\n"))
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			continue
+		}
+		if line == "LOGOUT" {
+			conn.Write([]byte("OK Goodbye\n"))
+			return
+		}
+		response, ok := s.responses[line]
+		if !ok {
+			response = []string{"ERR UNKNOWN-COMMAND"}
+		}
+		for _, responseLine := range response {
+			conn.Write([]byte(responseLine + "\n"))
+		}
+	}
+}
+
+func (s *fakeUpsd) dial(t *testing.T) *Client {
+	t.Helper()
+	client, err := Dial(context.Background(), s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeUpsd(t, map[string][]string{
+		"LIST UPS": {
+			"BEGIN LIST UPS",
+			`UPS rack1 "Rack 1 UPS"`,
+			`UPS rack2 "Unavailable"`,
+			"END LIST UPS",
+		},
+		"LIST VAR rack1": {
+			"BEGIN LIST VAR rack1",
+			`VAR rack1 battery.charge "100"`,
+			`VAR rack1 ups.status "OL CHRG"`,
+			`VAR rack1 ups.id "say \"hi\" \\o/"`,
+			`VAR rack1 ups.contacts ""`,
+			"END LIST VAR rack1",
+		},
+		"LIST CMD rack1": {
+			"BEGIN LIST CMD rack1",
+			"CMD rack1 beeper.mute",
+			"CMD rack1 test.battery.start.quick",
+			"END LIST CMD rack1",
+		},
+		"LIST RANGE rack1 input.transfer.high": {
+			"BEGIN LIST RANGE rack1 input.transfer.high",
+			`RANGE rack1 input.transfer.high "250" "280.5"`,
+			"END LIST RANGE rack1 input.transfer.high",
+		},
+		"LIST ENUM rack1 ups.beeper.status": {
+			"BEGIN LIST ENUM rack1 ups.beeper.status",
+			`ENUM rack1 ups.beeper.status "enabled"`,
+			`ENUM rack1 ups.beeper.status "disabled"`,
+			"END LIST ENUM rack1 ups.beeper.status",
+		},
+	}).dial(t)
+
+	upsList, err := client.ListUPS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []UPS{{"rack1", "Rack 1 UPS"}, {"rack2", "Unavailable"}}; !reflect.DeepEqual(upsList, want) {
+		t.Errorf("ListUPS: want %v, have %v", want, upsList)
+	}
+
+	variables, err := client.ListVariables(ctx, "rack1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantVariables := []Variable{
+		{"battery.charge", "100"},
+		{"ups.status", "OL CHRG"},
+		{"ups.id", `say "hi" \o/`},
+		{"ups.contacts", ""},
+	}
+	if !reflect.DeepEqual(variables, wantVariables) {
+		t.Errorf("ListVariables: want %v, have %v", wantVariables, variables)
+	}
+
+	commands, err := client.ListCommands(ctx, "rack1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"beeper.mute", "test.battery.start.quick"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("ListCommands: want %v, have %v", want, commands)
+	}
+
+	ranges, err := client.ListRange(ctx, "rack1", "input.transfer.high")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{{250, 280.5}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ListRange: want %v, have %v", want, ranges)
+	}
+
+	enum, err := client.ListEnum(ctx, "rack1", "ups.beeper.status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"enabled", "disabled"}; !reflect.DeepEqual(enum, want) {
+		t.Errorf("ListEnum: want %v, have %v", want, enum)
+	}
+}
+
+func TestGet(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeUpsd(t, map[string][]string{
+		"GET VAR rack1 battery.charge":           {`VAR rack1 battery.charge "100"`},
+		"GET DESC rack1 battery.charge":          {`DESC rack1 battery.charge "Battery charge (percent of full)"`},
+		"GET NUMLOGINS rack1":                    {"NUMLOGINS rack1 2"},
+		"GET TYPE rack1 ups.delay.shutdown":      {"TYPE rack1 ups.delay.shutdown RW STRING:10"},
+		"GET TYPE rack1 input.transfer.high":     {"TYPE rack1 input.transfer.high RW RANGE NUMBER"},
+		"GET VAR rack1 battery.mfr.date":         {"ERR VAR-NOT-SUPPORTED"},
+		"GET VAR rack1 battery.charge.mismatch":  {`VAR rack2 battery.charge.mismatch "1"`},
+		"PROTVER":                                {"ERR UNKNOWN-COMMAND"},
+		"NETVER":                                 {"1.2"},
+		"GET TRACKING 1bd31808-cb49-4aec-9d75-d": {"SUCCESS"},
+	}).dial(t)
+
+	value, err := client.GetVariable(ctx, "rack1", "battery.charge")
+	if err != nil || value != "100" {
+		t.Errorf("GetVariable: have %q, %v", value, err)
+	}
+
+	description, err := client.GetDescription(ctx, "rack1", "battery.charge")
+	if err != nil || description != "Battery charge (percent of full)" {
+		t.Errorf("GetDescription: have %q, %v", description, err)
+	}
+
+	logins, err := client.GetNumLogins(ctx, "rack1")
+	if err != nil || logins != 2 {
+		t.Errorf("GetNumLogins: have %d, %v", logins, err)
+	}
+
+	varType, err := client.GetType(ctx, "rack1", "ups.delay.shutdown")
+	if want := (VariableType{Writable: true, Types: []string{"STRING"}, MaxLength: 10}); err != nil || !reflect.DeepEqual(varType, want) {
+		t.Errorf("GetType: want %v, have %v, %v", want, varType, err)
+	}
+	varType, err = client.GetType(ctx, "rack1", "input.transfer.high")
+	if want := (VariableType{Writable: true, Types: []string{"RANGE", "NUMBER"}}); err != nil || !reflect.DeepEqual(varType, want) {
+		t.Errorf("GetType: want %v, have %v, %v", want, varType, err)
+	}
+
+	version, err := client.ProtocolVersion(ctx)
+	if err != nil || version != "1.2" {
+		t.Errorf("ProtocolVersion: have %q, %v", version, err)
+	}
+
+	status, err := client.GetTracking(ctx, "1bd31808-cb49-4aec-9d75-d")
+	if err != nil || status != TrackingSuccess {
+		t.Errorf("GetTracking: have %q, %v", status, err)
+	}
+
+	// Protocol errors leave the connection usable
+	_, err = client.GetVariable(ctx, "rack1", "battery.mfr.date")
+	if !IsErrorCode(err, "VAR-NOT-SUPPORTED") {
+		t.Errorf("expected VAR-NOT-SUPPORTED, have %v", err)
+	}
+	if _, err := client.GetVariable(ctx, "rack1", "battery.charge"); err != nil {
+		t.Errorf("connection not usable after ERR response: %v", err)
+	}
+
+	// Responses that do not match the request break the connection
+	if _, err := client.GetVariable(ctx, "rack1", "battery.charge.mismatch"); err == nil {
+		t.Error("expected an error for a mismatched response")
+	}
+	if _, err := client.GetVariable(ctx, "rack1", "battery.charge"); err == nil {
+		t.Error("expected the connection to be unusable after a mismatched response")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeUpsd(t, map[string][]string{
+		"USERNAME admin":                         {"OK"},
+		`PASSWORD "pass word"`:                   {"OK"},
+		"SET TRACKING ON":                        {"OK"},
+		"INSTCMD rack1 beeper.mute":              {"OK TRACKING 1bd31808"},
+		"INSTCMD rack1 load.off.delay 60":        {"OK"},
+		`SET VAR rack1 ups.id "my ups"`:          {"OK TRACKING 2bd31808"},
+		"INSTCMD rack1 load.off":                 {"ERR ACCESS-DENIED"},
+		"SET VAR rack1 input.transfer.high 1000": {"ERR INVALID-VALUE"},
+	}).dial(t)
+
+	if err := client.Authenticate(ctx, "admin", "pass word"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetTracking(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := client.RunCommand(ctx, "rack1", "beeper.mute")
+	if err != nil || id != "1bd31808" {
+		t.Errorf("RunCommand: have %q, %v", id, err)
+	}
+	id, err = client.RunCommand(ctx, "rack1", "load.off.delay", "60")
+	if err != nil || id != "" {
+		t.Errorf("RunCommand with value: have %q, %v", id, err)
+	}
+	id, err = client.SetVariable(ctx, "rack1", "ups.id", "my ups")
+	if err != nil || id != "2bd31808" {
+		t.Errorf("SetVariable: have %q, %v", id, err)
+	}
+	if _, err := client.RunCommand(ctx, "rack1", "load.off"); !IsErrorCode(err, "ACCESS-DENIED") {
+		t.Errorf("expected ACCESS-DENIED, have %v", err)
+	}
+	if _, err := client.SetVariable(ctx, "rack1", "input.transfer.high", "1000"); !IsErrorCode(err, "INVALID-VALUE") {
+		t.Errorf("expected INVALID-VALUE, have %v", err)
+	}
+	if err := client.Logout(ctx); err != nil {
+		t.Errorf("Logout: %v", err)
+	}
+}
+
+// selfSignedCertificate returns a certificate for 127.0.0.1 and a pool trusting it
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake upsd"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestStartTLS(t *testing.T) {
+	ctx := context.Background()
+	cert, pool := selfSignedCertificate(t)
+	server := newFakeUpsd(t, map[string][]string{
+		"VER": {"Network UPS Tools upsd 2.8.0"},
+	})
+	server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	client := server.dial(t)
+	if err := client.StartTLS(ctx, &tls.Config{RootCAs: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if !client.TLS() {
+		t.Error("expected the connection to report TLS")
+	}
+	if version, err := client.Version(ctx); err != nil || version != "Network UPS Tools upsd 2.8.0" {
+		t.Errorf("Version over TLS: have %q, %v", version, err)
+	}
+
+	// Certificates that can not be verified are rejected
+	client = server.dial(t)
+	if err := client.StartTLS(ctx, &tls.Config{}); err == nil {
+		t.Error("expected an untrusted certificate to fail the handshake")
+	}
+
+	// Servers without TLS answer with an ERR response
+	server.tlsConfig = nil
+	server.responses["STARTTLS"] = []string{"ERR FEATURE-NOT-CONFIGURED"}
+	client = server.dial(t)
+	if err := client.StartTLS(ctx, &tls.Config{RootCAs: pool}); !IsErrorCode(err, "FEATURE-NOT-CONFIGURED") {
+		t.Errorf("expected FEATURE-NOT-CONFIGURED, have %v", err)
+	}
+	if client.TLS() {
+		t.Error("expected the connection to report plain text")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	client := newFakeUpsd(t, map[string][]string{
+		"LIST UPS": nil,
+	}).dial(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.ListUPS(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, have %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request was not interrupted in time: %s", elapsed)
+	}
+
+	// The connection can not be trusted after an interrupted request
+	if _, err := client.Version(context.Background()); err == nil {
+		t.Error("expected the connection to be unusable after a timeout")
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	for line, want := range map[string][]string{
+		`VAR ups ups.status "OL CHRG"`: {"VAR", "ups", "ups.status", "OL CHRG"},
+		`VAR ups x ""`:                 {"VAR", "ups", "x", ""},
+		`VAR ups x "a \"b\" \\ c"`:     {"VAR", "ups", "x", `a "b" \ c`},
+		`NUMLOGINS ups  1`:             {"NUMLOGINS", "ups", "1"},
+	} {
+		have, err := splitLine(line)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+		} else if !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: want %q, have %q", line, want, have)
+		}
+	}
+
+	if _, err := splitLine(`VAR ups x "unterminated`); err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
+
+func TestEncodeLine(t *testing.T) {
+	have := encodeLine([]string{"SET", "VAR", "ups", "ups.id", `my "ups"`})
+	if want := `SET VAR ups ups.id "my \"ups\""`; have != want {
+		t.Errorf("want %s, have %s", want, have)
+	}
+	if have, want := encodeLine([]string{"PASSWORD", ""}), `PASSWORD ""`; have != want {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
@@ -0,0 +1,309 @@
+package nutclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Status of an instant command or set request reported by GET TRACKING
+const (
+	TrackingPending = "PENDING"
+	TrackingSuccess = "SUCCESS"
+)
+
+// UPS is an entry of LIST UPS
+type UPS struct {
+	Name        string
+	Description string
+}
+
+// Variable is an entry of LIST VAR or LIST RW
+type Variable struct {
+	Name  string
+	Value string
+}
+
+// Range is an entry of LIST RANGE
+type Range struct {
+	Min float64
+	Max float64
+}
+
+// VariableType is the result of GET TYPE
+type VariableType struct {
+	Writable bool
+	// Types holds the flags of the variable, such as NUMBER, STRING, ENUM or RANGE
+	Types []string
+	// MaxLength is the maximum length of STRING variables
+	MaxLength int
+}
+
+// Version returns the version of upsd
+func (c *Client) Version(ctx context.Context) (string, error) {
+	var version string
+	err := c.roundTrip(ctx, func() error {
+		var err error
+		version, err = c.command("VER")
+		return err
+	})
+	return version, err
+}
+
+// ProtocolVersion returns the version of the network protocol spoken by upsd
+func (c *Client) ProtocolVersion(ctx context.Context) (string, error) {
+	var version string
+	err := c.roundTrip(ctx, func() error {
+		var err error
+		version, err = c.command("PROTVER")
+		if IsErrorCode(err, "UNKNOWN-COMMAND") {
+			// Servers before NUT 2.8.0 only know the older name
+			version, err = c.command("NETVER")
+		}
+		return err
+	})
+	return version, err
+}
+
+// Authenticate sends the USERNAME and PASSWORD of the session
+func (c *Client) Authenticate(ctx context.Context, username, password string) error {
+	if err := c.simple(ctx, "USERNAME", username); err != nil {
+		return err
+	}
+	return c.simple(ctx, "PASSWORD", password)
+}
+
+// Logout ends the session. The connection is closed by upsd afterwards.
+func (c *Client) Logout(ctx context.Context) error {
+	return c.roundTrip(ctx, func() error {
+		line, err := c.command("LOGOUT")
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "OK") && line != "Goodbye..." {
+			return c.unexpected(line)
+		}
+		return nil
+	})
+}
+
+// ListUPS returns the UPS devices known to upsd
+func (c *Client) ListUPS(ctx context.Context) ([]UPS, error) {
+	items, err := c.list(ctx, "LIST", "UPS")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]UPS, 0, len(items))
+	for _, item := range items {
+		if len(item) != 2 {
+			return nil, fmt.Errorf("malformed UPS entry %q", item)
+		}
+		result = append(result, UPS{Name: item[0], Description: item[1]})
+	}
+	return result, nil
+}
+
+// ListVariables returns all variables of the UPS with their values
+func (c *Client) ListVariables(ctx context.Context, ups string) ([]Variable, error) {
+	return c.listVariables(ctx, "VAR", ups)
+}
+
+// ListWritable returns the writable variables of the UPS with their values
+func (c *Client) ListWritable(ctx context.Context, ups string) ([]Variable, error) {
+	return c.listVariables(ctx, "RW", ups)
+}
+
+func (c *Client) listVariables(ctx context.Context, kind, ups string) ([]Variable, error) {
+	items, err := c.list(ctx, "LIST", kind, ups)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Variable, 0, len(items))
+	for _, item := range items {
+		if len(item) != 2 {
+			return nil, fmt.Errorf("malformed %s entry %q", kind, item)
+		}
+		result = append(result, Variable{Name: item[0], Value: item[1]})
+	}
+	return result, nil
+}
+
+// ListCommands returns the instant commands supported by the UPS
+func (c *Client) ListCommands(ctx context.Context, ups string) ([]string, error) {
+	return c.listSingle(ctx, "LIST", "CMD", ups)
+}
+
+// ListClients returns the addresses of the clients logged in to the UPS
+func (c *Client) ListClients(ctx context.Context, ups string) ([]string, error) {
+	return c.listSingle(ctx, "LIST", "CLIENT", ups)
+}
+
+// ListEnum returns the values accepted by an ENUM variable
+func (c *Client) ListEnum(ctx context.Context, ups, variable string) ([]string, error) {
+	return c.listSingle(ctx, "LIST", "ENUM", ups, variable)
+}
+
+func (c *Client) listSingle(ctx context.Context, args ...string) ([]string, error) {
+	items, err := c.list(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if len(item) != 1 {
+			return nil, fmt.Errorf("malformed %s entry %q", args[1], item)
+		}
+		result = append(result, item[0])
+	}
+	return result, nil
+}
+
+// ListRange returns the ranges of values accepted by a RANGE variable
+func (c *Client) ListRange(ctx context.Context, ups, variable string) ([]Range, error) {
+	items, err := c.list(ctx, "LIST", "RANGE", ups, variable)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Range, 0, len(items))
+	for _, item := range items {
+		if len(item) != 2 {
+			return nil, fmt.Errorf("malformed RANGE entry %q", item)
+		}
+		low, err := strconv.ParseFloat(item[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed RANGE entry %q: %w", item, err)
+		}
+		high, err := strconv.ParseFloat(item[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed RANGE entry %q: %w", item, err)
+		}
+		result = append(result, Range{Min: low, Max: high})
+	}
+	return result, nil
+}
+
+// getSingle sends a GET request answered with a single value
+func (c *Client) getSingle(ctx context.Context, args ...string) (string, error) {
+	fields, err := c.get(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) != 1 {
+		return "", fmt.Errorf("malformed %s response %q", args[1], fields)
+	}
+	return fields[0], nil
+}
+
+// GetVariable returns the value of a variable of the UPS
+func (c *Client) GetVariable(ctx context.Context, ups, variable string) (string, error) {
+	return c.getSingle(ctx, "GET", "VAR", ups, variable)
+}
+
+// GetDescription returns the description of a variable. upsd may return
+// "Unavailable" if it has no description for the variable.
+func (c *Client) GetDescription(ctx context.Context, ups, variable string) (string, error) {
+	return c.getSingle(ctx, "GET", "DESC", ups, variable)
+}
+
+// GetCommandDescription returns the description of an instant command
+func (c *Client) GetCommandDescription(ctx context.Context, ups, command string) (string, error) {
+	return c.getSingle(ctx, "GET", "CMDDESC", ups, command)
+}
+
+// GetUPSDescription returns the description of the UPS from ups.conf
+func (c *Client) GetUPSDescription(ctx context.Context, ups string) (string, error) {
+	return c.getSingle(ctx, "GET", "UPSDESC", ups)
+}
+
+// GetNumLogins returns the number of clients logged in to the UPS
+func (c *Client) GetNumLogins(ctx context.Context, ups string) (int, error) {
+	value, err := c.getSingle(ctx, "GET", "NUMLOGINS", ups)
+	if err != nil {
+		return 0, err
+	}
+	logins, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("malformed number of logins %q: %w", value, err)
+	}
+	return logins, nil
+}
+
+// GetType returns the type of a variable
+func (c *Client) GetType(ctx context.Context, ups, variable string) (VariableType, error) {
+	result := VariableType{}
+	fields, err := c.get(ctx, "GET", "TYPE", ups, variable)
+	if err != nil {
+		return result, err
+	}
+	for _, field := range fields {
+		switch {
+		case field == "RW":
+			result.Writable = true
+		case strings.HasPrefix(field, "STRING:"):
+			result.Types = append(result.Types, "STRING")
+			result.MaxLength, err = strconv.Atoi(strings.TrimPrefix(field, "STRING:"))
+			if err != nil {
+				return result, fmt.Errorf("malformed TYPE response %q: %w", fields, err)
+			}
+		default:
+			result.Types = append(result.Types, field)
+		}
+	}
+	return result, nil
+}
+
+// SetTracking enables or disables tracking of instant commands and set
+// requests for the session
+func (c *Client) SetTracking(ctx context.Context, enabled bool) error {
+	state := "OFF"
+	if enabled {
+		state = "ON"
+	}
+	return c.simple(ctx, "SET", "TRACKING", state)
+}
+
+// GetTracking returns the status of a tracked instant command or set request:
+// TrackingPending, TrackingSuccess, or an *Error describing the failure
+func (c *Client) GetTracking(ctx context.Context, id string) (string, error) {
+	var status string
+	err := c.roundTrip(ctx, func() error {
+		var err error
+		status, err = c.command("GET", "TRACKING", id)
+		return err
+	})
+	return status, err
+}
+
+// RunCommand sends an instant command to the UPS. An optional value is passed
+// to commands that accept one. If tracking is enabled, the tracking ID of the
+// command is returned.
+func (c *Client) RunCommand(ctx context.Context, ups, command string, value ...string) (string, error) {
+	return c.tracked(ctx, append([]string{"INSTCMD", ups, command}, value...)...)
+}
+
+// SetVariable sets a writable variable of the UPS. If tracking is enabled,
+// the tracking ID of the request is returned.
+func (c *Client) SetVariable(ctx context.Context, ups, variable, value string) (string, error) {
+	return c.tracked(ctx, "SET", "VAR", ups, variable, value)
+}
+
+// tracked sends a request answered by OK, optionally followed by a tracking ID
+func (c *Client) tracked(ctx context.Context, args ...string) (string, error) {
+	var id string
+	err := c.roundTrip(ctx, func() error {
+		line, err := c.command(args...)
+		if err != nil {
+			return err
+		}
+		if line == "OK" {
+			return nil
+		}
+		if !strings.HasPrefix(line, "OK TRACKING ") {
+			return c.unexpected(line)
+		}
+		id = strings.TrimPrefix(line, "OK TRACKING ")
+		return nil
+	})
+	return id, err
+}
@@ -0,0 +1,56 @@
+package nutclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error is an ERR response sent by the NUT server. The connection is still
+// usable after such an error.
+type Error struct {
+	Code  string
+	Extra string
+}
+
+var errorDescriptions = map[string]string{
+	"ACCESS-DENIED":          "the host and/or authentication details are not sufficient to execute the command",
+	"UNKNOWN-UPS":            "the UPS is not known to upsd",
+	"VAR-NOT-SUPPORTED":      "the UPS does not support the variable",
+	"CMD-NOT-SUPPORTED":      "the UPS does not support the instant command",
+	"INVALID-ARGUMENT":       "an argument of the command is not recognized or invalid",
+	"INSTCMD-FAILED":         "upsd failed to deliver the instant command to the driver",
+	"SET-FAILED":             "upsd failed to deliver the set request to the driver",
+	"READONLY":               "the variable is not writable",
+	"TOO-LONG":               "the value is too long",
+	"FEATURE-NOT-SUPPORTED":  "upsd does not support the feature",
+	"FEATURE-NOT-CONFIGURED": "upsd is not configured for the feature",
+	"ALREADY-SSL-MODE":       "TLS is already enabled on the connection",
+	"DRIVER-NOT-CONNECTED":   "the driver of the UPS is not connected to upsd",
+	"DATA-STALE":             "the driver of the UPS is not providing fresh data",
+	"ALREADY-LOGGED-IN":      "the client already logged in to a UPS",
+	"INVALID-PASSWORD":       "the password is invalid",
+	"ALREADY-SET-PASSWORD":   "the password was already set",
+	"INVALID-USERNAME":       "the username is invalid",
+	"ALREADY-SET-USERNAME":   "the username was already set",
+	"USERNAME-REQUIRED":      "the command requires a username",
+	"PASSWORD-REQUIRED":      "the command requires a password",
+	"UNKNOWN-COMMAND":        "upsd does not recognize the command",
+	"INVALID-VALUE":          "the value is not valid for the variable",
+}
+
+func (e *Error) Error() string {
+	description, ok := errorDescriptions[e.Code]
+	if !ok {
+		description = "unknown error"
+	}
+	if e.Extra != "" {
+		return fmt.Sprintf("NUT error %s (%s): %s", e.Code, e.Extra, description)
+	}
+	return fmt.Sprintf("NUT error %s: %s", e.Code, description)
+}
+
+// IsErrorCode reports whether err is an ERR response of the NUT server with the given code
+func IsErrorCode(err error, code string) bool {
+	var nutErr *Error
+	return errors.As(err, &nutErr) && nutErr.Code == code
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+// overrideParams are the query string parameters overriding collector options
+var overrideParams = []string{"ups", "server", "serverport", "username", "password", "variables", "statuses"}
+
+// Reasons for rejecting a scrape
+const (
+	rejectOverride = "override_disabled"
+	rejectServer   = "server_not_allowed"
+	rejectPort     = "port_not_allowed"
+)
+
+var rejectedScrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "nut_exporter",
+	Name:      "rejected_scrapes_total",
+	Help:      "Scrapes rejected because of a disabled query string parameter or a NUT server that is not allowed, by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(rejectedScrapes)
+	for _, reason := range []string{rejectOverride, rejectServer, rejectPort} {
+		rejectedScrapes.WithLabelValues(reason)
+	}
+}
+
+// overridePolicy restricts the query string parameters of scrapes
+type overridePolicy struct {
+	// disabled holds the parameters that are rejected
+	disabled []string
+
+	// Servers and ports that may be set with the server and serverport parameters. Empty lists
+	// allow any.
+	hosts    []string
+	networks []*net.IPNet
+	ports    []int
+}
+
+// newOverridePolicy parses the lists of disabled parameters, allowed servers and allowed ports.
+// Servers are hostnames, IP addresses or CIDR ranges.
+func newOverridePolicy(disabled, servers, ports []string) (*overridePolicy, error) {
+	policy := &overridePolicy{}
+
+	for _, param := range disabled {
+		switch {
+		case param == "all":
+			policy.disabled = slices.Clone(overrideParams)
+		case slices.Contains(overrideParams, param):
+			policy.disabled = append(policy.disabled, param)
+		default:
+			return nil, fmt.Errorf("unknown query string parameter %q, expected all or one of %s", param, strings.Join(overrideParams, ", "))
+		}
+	}
+
+	for _, server := range servers {
+		if _, network, err := net.ParseCIDR(server); err == nil {
+			policy.networks = append(policy.networks, network)
+			continue
+		}
+		if ip := net.ParseIP(server); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			policy.networks = append(policy.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if strings.ContainsAny(server, "/:") {
+			return nil, fmt.Errorf("invalid allowed server %q", server)
+		}
+		policy.hosts = append(policy.hosts, strings.ToLower(server))
+	}
+
+	for _, port := range ports {
+		number, err := strconv.Atoi(port)
+		if err != nil || number < 1 || number > 65535 {
+			return nil, fmt.Errorf("invalid allowed port %q", port)
+		}
+		policy.ports = append(policy.ports, number)
+	}
+	return policy, nil
+}
+
+// check returns the reason for rejecting a scrape with the query string and the options it
+// resolved to, or an empty string if it is allowed. Servers of the command line and of targets are
+// trusted, so the server allowlist only applies to scrapes that set the server and the port
+// allowlist to scrapes that set the server or port.
+func (p *overridePolicy) check(query url.Values, opts collectors.NutCollectorOpts) string {
+	for _, param := range p.disabled {
+		if query.Get(param) != "" {
+			return rejectOverride
+		}
+	}
+
+	if query.Get("server") != "" && !p.allowsServer(opts.Server) {
+		return rejectServer
+	}
+	if query.Get("server") == "" && query.Get("serverport") == "" {
+		return ""
+	}
+	if len(p.ports) > 0 && !slices.Contains(p.ports, opts.ServerPort) {
+		return rejectPort
+	}
+	return ""
+}
+
+// allowsServer checks a server against the allowlist. Hostnames are not resolved, so they only
+// match hostnames of the allowlist.
+func (p *overridePolicy) allowsServer(server string) bool {
+	if len(p.hosts) == 0 && len(p.networks) == 0 {
+		return true
+	}
+	if ip := net.ParseIP(server); ip != nil {
+		return slices.ContainsFunc(p.networks, func(network *net.IPNet) bool { return network.Contains(ip) })
+	}
+	return slices.Contains(p.hosts, strings.ToLower(strings.TrimSuffix(server, ".")))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+func TestOverridePolicy(t *testing.T) {
+	policy, err := newOverridePolicy([]string{"password"}, []string{"nut.example.com", "10.0.0.0/24", "2001:db8::1"}, []string{"3493"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for query, want := range map[string]string{
+		"":                                  "",
+		"ups=rack1":                         "",
+		"password=secret":                   rejectOverride,
+		"server=10.0.0.5":                   "",
+		"server=NUT.example.com":            "",
+		"server=10.0.1.5":                   rejectServer,
+		"server=2001:db8::1":                "",
+		"server=example.com":                rejectServer,
+		"server=10.0.0.5&serverport=3494":   rejectPort,
+		"serverport=3494":                   rejectPort,
+		"serverport=3493":                   "",
+		"server=10.0.0.5&serverport=bad":    "",
+		"target=garage&server=169.254.1.10": rejectServer,
+	} {
+		values, _ := url.ParseQuery(query)
+		opts := collectors.NutCollectorOpts{Server: "127.0.0.1", ServerPort: 3493}
+		if server := values.Get("server"); server != "" {
+			opts.Server = server
+		}
+		if values.Get("serverport") == "3494" {
+			opts.ServerPort = 3494
+		}
+		if have := policy.check(values, opts); have != want {
+			t.Errorf("%q: want %q, have %q", query, want, have)
+		}
+	}
+
+	for name, args := range map[string][3][]string{
+		"param":  {{"target"}, nil, nil},
+		"server": {nil, {"10.0.0.0/33"}, nil},
+		"port":   {nil, nil, {"0"}},
+	} {
+		if _, err := newOverridePolicy(args[0], args[1], args[2]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+	"github.com/DRuggeri/nut_exporter/v3/config"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nut_exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nut_exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+}
+
+// loadConfig reads the configuration file, if one was given. Settings of targets that are only
+// invalid in combination with the command line flags are rejected as well.
+func loadConfig() (*config.Config, error) {
+	if *configFile == "" {
+		return &config.Config{}, nil
+	}
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, target := range cfg.Targets {
+		opts := target.Apply(collectorOpts)
+		if err := collectors.ValidateDeviceLabels(opts.DeviceLabels, opts.IdentityLabels); err != nil {
+			return nil, fmt.Errorf("error validating %s: target %s: %w", *configFile, name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// reload re-reads the configuration and drops every cached handler whose collector options
+// are no longer what the scrape that created it would resolve to
+func (h *metricsHandler) reload() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	if h.batteryTests != nil {
+		if err := h.batteryTests.Update(batteryTests(cfg, h.credentials)); err != nil {
+			configReloadSuccess.Set(0)
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.config = cfg
+	h.generation++
+	h.handlers.removeIf(func(cached *cachedHandler) bool {
+		opts, err := h.collectorOpts(cached.query)
+		return err != nil || !reflect.DeepEqual(opts, cached.opts)
+	})
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
+
+// batteryTests returns the battery tests scheduled by the targets of the configuration. Targets
+// without a user of their own log in with the credentials of the store as of now.
+func batteryTests(cfg *config.Config, credentials *credentialStore) map[string]collectors.BatteryTest {
+	tests := make(map[string]collectors.BatteryTest)
+	for name, target := range cfg.Targets {
+		if target.BatteryTest == nil {
+			continue
+		}
+		opts := target.Apply(collectorOpts)
+		if target.Username == "" && credentials != nil {
+			credentials.apply(&opts)
+		}
+		tests[name] = collectors.BatteryTest{
+			Opts:     opts,
+			Schedule: target.BatteryTest.Schedule,
+			Type:     target.BatteryTest.Type,
+			Timeout:  target.BatteryTest.TimeoutDuration(),
+		}
+	}
+	return tests
+}
+
+// watchReloads reloads the configuration whenever the process receives SIGHUP
+func (h *metricsHandler) watchReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		logger.Info("Received SIGHUP, reloading configuration")
+		if err := h.reload(); err != nil {
+			logger.Error("Failed to reload configuration", "err", err)
+			continue
+		}
+		logger.Info("Configuration reloaded")
+	}
+}
+
+// reloadHandler serves the /-/reload endpoint
+func (h *metricsHandler) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !*enableLifecycle {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Lifecycle API is not enabled, start the exporter with --web.enable-lifecycle"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("405 - Only POST requests are allowed"))
+		return
+	}
+
+	logger.Info("Reload requested over HTTP", "remote", r.RemoteAddr)
+	if err := h.reload(); err != nil {
+		logger.Error("Failed to reload configuration", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Failed to reload configuration: " + err.Error()))
+		return
+	}
+	logger.Info("Configuration reloaded")
+	w.Write([]byte("Configuration reloaded"))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+func TestLoadConfigIdentityLabels(t *testing.T) {
+	defer func(file string, opts collectors.NutCollectorOpts) {
+		*configFile, collectorOpts = file, opts
+	}(*configFile, collectorOpts)
+	collectorOpts = collectors.NutCollectorOpts{DeviceLabels: []string{"model", "rack"}}
+
+	for content, valid := range map[string]bool{
+		"targets:\n  foo:\n    identity_labels: [rack]\n":                                           true,
+		"targets:\n  foo:\n    identity_labels: [location]\n":                                       false,
+		"targets:\n  foo:\n    device_labels: [model, location]\n    identity_labels: [location]\n": true,
+	} {
+		*configFile = filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(*configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(); (err == nil) != valid {
+			t.Errorf("%q: want valid %t, have error %v", content, valid, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+)
+
+// sdGroup is a target group of the Prometheus HTTP service discovery format
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdSource is a NUT server to list UPS devices from, either the one of the command line flags or
+// the one of a target of the configuration file
+type sdSource struct {
+	// target is empty for the command line flags
+	target string
+	opts   collectors.NutCollectorOpts
+}
+
+// name identifies the source in logs and in the cache of discovered UPS devices
+func (s sdSource) name() string {
+	name := fmt.Sprintf("%s:%d/%s", s.opts.Server, s.opts.ServerPort, s.opts.Ups)
+	if s.target != "" {
+		name = fmt.Sprintf("%s (target %s)", name, s.target)
+	}
+	return name
+}
+
+// sdSources returns the command line server followed by the targets of the configuration
+func (h *metricsHandler) sdSources() []sdSource {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	opts, _ := h.collectorOpts(url.Values{})
+	sources := []sdSource{{opts: opts}}
+
+	names := make([]string, 0, len(h.config.Targets))
+	for name := range h.config.Targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		opts, _ := h.collectorOpts(url.Values{"target": {name}})
+		sources = append(sources, sdSource{target: name, opts: opts})
+	}
+	return sources
+}
+
+// discover lists the UPS devices of a source. If the NUT server can not be read, the devices found
+// by the last successful attempt are returned so that Prometheus does not drop their targets.
+func (h *metricsHandler) discover(ctx context.Context, source sdSource) []collectors.DiscoveredUPS {
+	//One scrape covers all UPS devices in multi UPS mode
+	if source.opts.MultiUps && source.opts.Ups == "" {
+		return []collectors.DiscoveredUPS{{}}
+	}
+
+	found, err := collectors.DiscoverUPS(ctx, source.opts, logger)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		logger.Warn("Failure listing UPS devices for service discovery", "source", source.name(), "err", err)
+		return h.discovered[source.name()]
+	}
+	h.discovered[source.name()] = found
+	return found
+}
+
+// sdHandler serves the UPS devices of all configured NUT servers in the Prometheus HTTP service
+// discovery format. Each UPS becomes a target scraping this exporter with the query string
+// parameters selecting it. UPS devices that would need a parameter disabled by the override policy
+// are left out.
+func (h *metricsHandler) sdHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if *defaultScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *defaultScrapeTimeout)
+		defer cancel()
+	}
+
+	sources := h.sdSources()
+	found := make([][]collectors.DiscoveredUPS, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found[i] = h.discover(ctx, source)
+		}()
+	}
+	wg.Wait()
+
+	groups := []sdGroup{}
+	for i, source := range sources {
+		for _, ups := range found[i] {
+			query := url.Values{"server": {source.opts.Server}}
+			opts := source.opts
+			if source.target != "" {
+				query.Set("target", source.target)
+			}
+			if ups.Name != "" && ups.Name != source.opts.Ups {
+				query.Set("ups", ups.Name)
+				opts.Ups = ups.Name
+			}
+
+			//The server parameter lets relabelling point scrapes at other servers. The scrape reads
+			//the server of the command line or the target without it, so it is left out rather than
+			//skipping the UPS if the override policy rejects it.
+			reason := h.overrides.check(query, opts)
+			if reason != "" {
+				query.Del("server")
+				reason = h.overrides.check(query, opts)
+			}
+			if reason != "" {
+				logger.Debug("Skipping UPS rejected by the override policy", "source", source.name(), "ups", ups.Name, "reason", reason)
+				continue
+			}
+
+			labels := map[string]string{
+				"__metrics_path__": *metricsPath,
+				"nut_server":       fmt.Sprintf("%s:%d", source.opts.Server, source.opts.ServerPort),
+			}
+			for param := range query {
+				labels["__param_"+param] = query.Get(param)
+			}
+			if source.target != "" {
+				labels["nut_target"] = source.target
+			}
+			if ups.Name != "" {
+				labels["ups"] = ups.Name
+			}
+			if ups.Description != "" {
+				labels["description"] = ups.Description
+			}
+			if ups.Location != "" {
+				labels["location"] = ups.Location
+			}
+			groups = append(groups, sdGroup{Targets: []string{r.Host}, Labels: labels})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
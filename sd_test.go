@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DRuggeri/nut_exporter/v3/collectors"
+	"github.com/DRuggeri/nut_exporter/v3/config"
+)
+
+func TestSdHandlerOverridePolicy(t *testing.T) {
+	//Nothing listens on the port, so the UPS devices listed before are served
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	defer func(opts collectors.NutCollectorOpts) { collectorOpts = opts }(collectorOpts)
+	collectorOpts = collectors.NutCollectorOpts{Server: "127.0.0.1", ServerPort: port}
+
+	multiUps := true
+	h := &metricsHandler{
+		config: &config.Config{Targets: map[string]config.Target{"garage": {MultiUps: &multiUps}}},
+		discovered: map[string][]collectors.DiscoveredUPS{
+			sdSource{opts: collectorOpts}.name(): {{Name: "rack1"}, {Name: "rack2"}},
+		},
+	}
+
+	for disabled, want := range map[string][]map[string]string{
+		"": {
+			{"__param_server": "127.0.0.1", "__param_ups": "rack1", "ups": "rack1"},
+			{"__param_server": "127.0.0.1", "__param_ups": "rack2", "ups": "rack2"},
+			{"__param_server": "127.0.0.1", "__param_target": "garage", "nut_target": "garage"},
+		},
+		"server": {
+			{"__param_ups": "rack1", "ups": "rack1"},
+			{"__param_ups": "rack2", "ups": "rack2"},
+			{"__param_target": "garage", "nut_target": "garage"},
+		},
+		"ups": {
+			{"__param_server": "127.0.0.1", "__param_target": "garage", "nut_target": "garage"},
+		},
+	} {
+		h.overrides, err = newOverridePolicy(splitVariables(disabled), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.sdHandler(w, httptest.NewRequest("GET", "/sd", nil))
+		groups := []sdGroup{}
+		if err := json.NewDecoder(w.Body).Decode(&groups); err != nil {
+			t.Fatal(err)
+		}
+
+		have := []map[string]string{}
+		for _, group := range groups {
+			delete(group.Labels, "__metrics_path__")
+			delete(group.Labels, "nut_server")
+			have = append(have, group.Labels)
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("disabled %q: want %v, have %v", disabled, want, have)
+		}
+	}
+}